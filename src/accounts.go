@@ -0,0 +1,77 @@
+package main
+
+import (
+	irc "github.com/fluffle/goirc/client"
+	"strings"
+)
+
+func (zax *ZAX) clear_accounts() {
+	zax.account_lock.Lock()
+	zax.accounts = make(map[string]string)
+	zax.account_lock.Unlock()
+}
+
+// "*" or an empty account means logged out.
+func (zax *ZAX) set_account(nick, account string) {
+	zax.account_lock.Lock()
+	defer zax.account_lock.Unlock()
+	if account == "" || account == "*" {
+		delete(zax.accounts, strings.ToLower(nick))
+		return
+	}
+	zax.accounts[strings.ToLower(nick)] = account
+}
+
+// Services account the sender of a line is logged in to, empty if none or unknown.
+// With account-tag the server tells us on every message, otherwise we go by what
+// extended-join and account-notify told us.
+func (zax *ZAX) account_of(line *irc.Line) string {
+	if zax.IrcClient.HasCapability("account-tag") {
+		return line.Tags["account"]
+	}
+	zax.account_lock.Lock()
+	defer zax.account_lock.Unlock()
+	return zax.accounts[strings.ToLower(line.Nick)]
+}
+
+// Accounts are forgotten as soon as we can't see the user anymore, since someone
+// else could take the nick without us noticing.
+func (zax *ZAX) setup_accounts(c *irc.Conn) {
+	zax.clear_accounts()
+	c.HandleFunc(irc.JOIN,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			// extended-join: channel, account, real name
+			if conn.HasCapability("extended-join") && len(line.Args) > 1 {
+				zax.set_account(line.Nick, line.Args[1])
+			}
+		}))
+	c.HandleFunc("ACCOUNT",
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 0 {
+				zax.set_account(line.Nick, line.Args[0])
+			}
+		}))
+	c.HandleFunc(irc.NICK,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if len(line.Args) == 0 {
+				return
+			}
+			zax.account_lock.Lock()
+			account := zax.accounts[strings.ToLower(line.Nick)]
+			zax.account_lock.Unlock()
+			zax.set_account(line.Nick, "")
+			zax.set_account(line.Args[0], account)
+		}))
+	for _, event := range []string{irc.PART, irc.QUIT} {
+		c.HandleFunc(event,
+			locked(func(conn *irc.Conn, line *irc.Line) {
+				zax.set_account(line.Nick, "")
+			}))
+	}
+	c.HandleFunc(irc.KICK,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 {
+				zax.set_account(line.Args[1], "")
+			}
+		}))
+}
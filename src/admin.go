@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	irc "github.com/fluffle/goirc/client"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A "%% <name>" subcommand. Func replies on success and returns an error otherwise,
+// which is reported back to whoever ran it.
+type AdminCommand struct {
+	Name    string
+	Usage   string
+	Args    int // Minimum number of arguments.
+	MinRole Role
+	Func    func(ctx *CommandContext, args []string) error
+}
+
+// A function rather than a var, since reload refers back to the registry that uses this.
+func admin_commands() []*AdminCommand {
+	return []*AdminCommand{
+		{"join", "<#chan> [ <key> ] -- #chan may be written network/#chan", 1, RoleAdmin, admin_join},
+		{"part", "<#chan> [ <message> ]", 1, RoleAdmin, admin_part},
+		{"say", "<target> <text>", 2, RoleAdmin, admin_say},
+		{"act", "<target> <text>", 2, RoleAdmin, admin_act},
+		{"nick", "<nick> [ <network> ]", 1, RoleAdmin, admin_nick},
+		{"reload", "-- re-read the config file", 0, RoleAdmin, admin_reload},
+		{"opt", "[ list | get <name> | set <name> <value> | unset <name> ] -- put a #chan before the name for channel overrides", 0, RoleAdmin, admin_opt},
+		{"ignore", "[ add <mask> [ <duration> ] [ <scope>,... ] [ text:<text or /regex/> ] | del <mask> | list ] -- the text is the rest of the line, or put it in quotes", 1, RoleAdmin, admin_ignore},
+		{"audit", "[ <page> ] -- privileged commands, newest first", 0, RoleAdmin, admin_audit},
+		{"reindex", "-- rebuild the message search index from the history", 0, RoleAdmin, admin_reindex},
+		{"raw", "<line> -- send a line to the server as is", 1, RoleOwner, admin_raw},
+		{"restart", "[ <message> ]", 0, RoleOwner, admin_restart},
+	}
+}
+
+// Set by "%% restart", main execs itself again once every network has quit.
+var restart_requested bool
+
+func find_admin_command(name string) *AdminCommand {
+	for _, sub := range admin_commands() {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+func admin_names(role Role) string {
+	names := []string{}
+	for _, sub := range admin_commands() {
+		if sub.MinRole <= role {
+			names = append(names, sub.Name)
+		}
+	}
+	return strings.Join(names, " | ")
+}
+
+// Help pages for "?h %% <name>".
+func admin_topics() map[string]string {
+	topics := make(map[string]string)
+	for _, sub := range admin_commands() {
+		topics[sub.Name] = fmt.Sprintf("Syntax: %%%% %s %s (%s)", sub.Name, sub.Usage, sub.MinRole)
+	}
+	return topics
+}
+
+func cmd_admin(ctx *CommandContext) {
+	if len(ctx.Args) < 2 {
+		ctx.Reply("Syntax: %% [ " + admin_names(ctx.Role) + " ] -- " + ctx.Prefix + "help %% <cmd> for more info.")
+		return
+	}
+	sub := find_admin_command(ctx.Args[1])
+	if sub == nil {
+		ctx.Reply(fmt.Sprintf("Unknown admin command %s, try one of: %s", ctx.Args[1], admin_names(ctx.Role)))
+		ctx.Err = errors.New("unknown command")
+		return
+	}
+	if sub.MinRole > ctx.Role {
+		ctx.Reply(fmt.Sprintf("%s needs the %s role.", sub.Name, sub.MinRole))
+		ctx.Err = fmt.Errorf("denied, needs %s", sub.MinRole)
+		return
+	}
+	args := ctx.Args[2:]
+	if len(args) < sub.Args {
+		ctx.Reply(fmt.Sprintf("Syntax: %%%% %s %s", sub.Name, sub.Usage))
+		ctx.Err = errors.New("missing arguments")
+		return
+	}
+	log.Noticef("%s (%s) ran admin command: %s", ctx.Sender, ctx.SenderHost, strings.Join(ctx.Args[1:], " "))
+	if err := sub.Func(ctx, args); err != nil {
+		log.Warningf("Admin command %s failed: %s", sub.Name, err.Error())
+		ctx.Reply(fmt.Sprintf("%s failed: %s", sub.Name, err.Error()))
+		ctx.Err = err
+	}
+}
+
+// Targets can be given as network/target to use another network than the command came from.
+func admin_target(ctx *CommandContext, target string) (*ZAX, string, error) {
+	zax := ctx.Zax
+	if i := strings.Index(target, "/"); i > 0 {
+		zax = find_network(target[:i])
+		if zax == nil {
+			return nil, "", fmt.Errorf("no network called %s", target[:i])
+		}
+		target = target[i+1:]
+	}
+	if target == "" {
+		return nil, "", errors.New("no target given")
+	}
+	if !zax.IrcClient.Connected() {
+		return nil, "", fmt.Errorf("not connected to %s", zax.Name)
+	}
+	return zax, target, nil
+}
+
+func is_channel(name string) bool {
+	return name != "" && strings.ContainsAny(name[:1], "#&+!")
+}
+
+func admin_join(ctx *CommandContext, args []string) error {
+	zax, channel, err := admin_target(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if !is_channel(channel) {
+		return fmt.Errorf("%s is not a channel", channel)
+	}
+	zax.await_join(channel, join_reply(ctx, zax, channel))
+	if len(args) > 1 {
+		zax.IrcClient.Join(channel, args[1])
+	} else {
+		zax.IrcClient.Join(channel)
+	}
+	return nil
+}
+
+// Tells whoever ran "%% join" how it went once the server answered.
+func join_reply(ctx *CommandContext, zax *ZAX, channel string) func(err error) {
+	return func(err error) {
+		if err != nil {
+			ctx.Reply(fmt.Sprintf("join failed: %s", err.Error()))
+		} else {
+			ctx.Reply(fmt.Sprintf("Joined %s on %s.", channel, zax.Name))
+		}
+	}
+}
+
+func admin_part(ctx *CommandContext, args []string) error {
+	zax, channel, err := admin_target(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if !is_channel(channel) {
+		return fmt.Errorf("%s is not a channel", channel)
+	}
+	if len(args) > 1 {
+		zax.IrcClient.Part(channel, strings.Join(args[1:], " "))
+	} else {
+		zax.IrcClient.Part(channel)
+	}
+	ctx.Reply(fmt.Sprintf("Left %s on %s.", channel, zax.Name))
+	return nil
+}
+
+func admin_say(ctx *CommandContext, args []string) error {
+	zax, target, err := admin_target(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	ctx.Say(zax, target, strings.Join(args[1:], " "))
+	if zax != ctx.Zax || target != ctx.ReplyTo {
+		ctx.Reply(fmt.Sprintf("Sent to %s on %s.", target, zax.Name))
+	}
+	return nil
+}
+
+func admin_act(ctx *CommandContext, args []string) error {
+	zax, target, err := admin_target(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	ctx.Act(zax, target, strings.Join(args[1:], " "))
+	if zax != ctx.Zax || target != ctx.ReplyTo {
+		ctx.Reply(fmt.Sprintf("Sent to %s on %s.", target, zax.Name))
+	}
+	return nil
+}
+
+// The new nick replaces the configured one until the config is reloaded, or we'd reclaim the old one.
+func admin_nick(ctx *CommandContext, args []string) error {
+	zax := ctx.Zax
+	if len(args) > 1 {
+		zax = find_network(args[1])
+		if zax == nil {
+			return fmt.Errorf("no network called %s", args[1])
+		}
+	}
+	nick := args[0]
+	if nick == "" || strings.ContainsAny(nick, " ,*?!@#&:") || strings.ContainsAny(nick[:1], "0123456789-") {
+		return fmt.Errorf("%s is not a valid nick", nick)
+	}
+	if !zax.IrcClient.Connected() {
+		return fmt.Errorf("not connected to %s", zax.Name)
+	}
+	zax.Config.Nickname = nick
+	zax.IrcClient.Nick(nick)
+	ctx.Reply(fmt.Sprintf("Changing nick on %s to %s.", zax.Name, nick))
+	return nil
+}
+
+// Commands run in a handler, which holds the config lock for reading, so the reload
+// is left to main like SIGHUP. The reply comes once it's done.
+func admin_reload(ctx *CommandContext, args []string) error {
+	done := func(changes []string, err error) {
+		switch {
+		case err != nil:
+			log.Errorf("Reload failed, keeping the old config: %s", err.Error())
+			ctx.Reply("Reload failed, keeping the old config: " + err.Error())
+		case len(changes) == 0:
+			ctx.Reply("Reloaded, nothing changed.")
+		default:
+			ctx.Reply("Reloaded: " + strings.Join(changes, ", "))
+		}
+	}
+	select {
+	case reload_requests <- done:
+		return nil
+	default:
+		return errors.New("a reload is already on its way")
+	}
+}
+
+func admin_reindex(ctx *CommandContext, args []string) error {
+	count, err := rebuild_index()
+	if err != nil {
+		return err
+	}
+	ctx.Reply(fmt.Sprintf("Indexed %d messages.", count))
+	return nil
+}
+
+func admin_ignore(ctx *CommandContext, args []string) error {
+	switch args[0] {
+	case "list":
+		entries := ignores.Entries()
+		if len(entries) == 0 {
+			ctx.Reply("Nobody is ignored.")
+			return nil
+		}
+		list := []string{}
+		for _, entry := range entries {
+			list = append(list, entry.String())
+		}
+		ctx.Reply("Ignored: " + strings.Join(list, " | "))
+	case "add":
+		if len(args) < 2 {
+			return errors.New("no mask given")
+		}
+		entry, err := ignore_entry(ctx, args[1], args[2:])
+		if err != nil {
+			return err
+		}
+		log.Noticef("%s added ignore entry %s.", ctx.Sender, entry.String())
+		ctx.Reply("Ignoring " + entry.String())
+	case "del":
+		if len(args) < 2 {
+			return errors.New("no mask given")
+		}
+		if !ignores.Remove(args[1]) {
+			return fmt.Errorf("%s is not on the ignore list", args[1])
+		}
+		log.Noticef("%s removed ignore entry %s.", ctx.Sender, args[1])
+		ctx.Reply("No longer ignoring " + args[1])
+	default:
+		return fmt.Errorf("unknown ignore command %s", args[0])
+	}
+	return nil
+}
+
+func admin_raw(ctx *CommandContext, args []string) error {
+	if !ctx.Zax.IrcClient.Connected() {
+		return fmt.Errorf("not connected to %s", ctx.Zax.Name)
+	}
+	ctx.Zax.IrcClient.Raw(strings.Join(args, " "))
+	ctx.Reply("Sent.")
+	return nil
+}
+
+func admin_restart(ctx *CommandContext, args []string) error {
+	if _, err := os.Executable(); err != nil {
+		return err
+	}
+	msg := "Restarting."
+	if len(args) > 0 {
+		msg = strings.Join(args, " ")
+	}
+	restart_requested = true
+	quit_all(msg)
+	return nil
+}
+
+// Replace the process with a fresh copy of itself, same arguments and environment.
+func restart() {
+	path, err := os.Executable()
+	if err != nil {
+		log.Errorf("Unable to restart: %s", err.Error())
+		return
+	}
+	log.Noticef("Restarting %s", path)
+	if err := syscall.Exec(path, os.Args, os.Environ()); err != nil {
+		log.Errorf("Unable to restart: %s", err.Error())
+	}
+}
+
+// Join errors: no such channel, too many channels, full, invite only, banned, bad key.
+var join_errors = []string{"403", "405", "471", "473", "474", "475", "477"}
+
+type join_waiter struct {
+	done func(err error)
+}
+
+// Call done once joining channel succeeded, failed, or the server didn't answer in time.
+func (zax *ZAX) await_join(channel string, done func(err error)) {
+	key := strings.ToLower(channel)
+	waiter := &join_waiter{done}
+	zax.join_lock.Lock()
+	if zax.join_waiters == nil {
+		zax.join_waiters = make(map[string]*join_waiter)
+	}
+	zax.join_waiters[key] = waiter
+	zax.join_lock.Unlock()
+	time.AfterFunc(auth_timeout, func() {
+		zax.join_lock.Lock()
+		current := zax.join_waiters[key] == waiter
+		zax.join_lock.Unlock()
+		if current {
+			zax.joined_channel(channel, fmt.Errorf("no answer from the server about %s", channel))
+		}
+	})
+}
+
+func (zax *ZAX) joined_channel(channel string, err error) {
+	key := strings.ToLower(channel)
+	zax.join_lock.Lock()
+	waiter, ok := zax.join_waiters[key]
+	delete(zax.join_waiters, key)
+	zax.join_lock.Unlock()
+	if ok {
+		waiter.done(err)
+	}
+}
+
+func (zax *ZAX) setup_join_replies(c *irc.Conn) {
+	c.HandleFunc(irc.JOIN,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if strings.EqualFold(line.Nick, zax.current_nick()) {
+				zax.joined_channel(line.Target(), nil)
+			}
+		}))
+	for _, numeric := range join_errors {
+		c.HandleFunc(numeric,
+			locked(func(conn *irc.Conn, line *irc.Line) {
+				zax.join_failed(line)
+			}))
+	}
+}
+
+// A join error numeric, e.g. "474 zax #chan :Cannot join channel (+b)".
+func (zax *ZAX) join_failed(line *irc.Line) {
+	if len(line.Args) > 1 {
+		zax.joined_channel(line.Args[1], fmt.Errorf("%s: %s", line.Args[1], line.Text()))
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flood"
+	irc "github.com/fluffle/goirc/client"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A network that isn't connected, with whatever it sends going to sent.
+func test_network(name string) (*ZAX, chan string) {
+	sent := make(chan string, 100)
+	cfg := irc.NewConfig("zax")
+	zax := &ZAX{Name: name, Config: NetworkConfig{Name: name, Nickname: "zax"}, IrcConfig: cfg, IrcClient: irc.Client(cfg)}
+	zax.queue = flood.NewQueue(1000, 100, 0, func(target, text string) {
+		sent <- target + " " + text
+	}, func() bool { return true })
+	go zax.queue.Run()
+	return zax, sent
+}
+
+func next_line(t *testing.T, sent chan string) string {
+	t.Helper()
+	select {
+	case line := <-sent:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("nothing was sent")
+		return ""
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	saved := networks
+	defer func() { networks = saved }()
+	zax, sent := test_network("net")
+	defer zax.queue.Stop()
+	networks = []*ZAX{zax}
+
+	tests := []struct {
+		args  string
+		role  Role
+		reply string
+		err   string
+	}{
+		{"%%", RoleAdmin, "Syntax: %% [ join | part | say | act | nick", ""},
+		{"%% nonsense", RoleAdmin, "Unknown admin command nonsense", "unknown command"},
+		{"%% Join #chan", RoleAdmin, "Unknown admin command Join", "unknown command"},
+		{"%% raw PRIVMSG x :y", RoleAdmin, "raw needs the owner role.", "denied, needs owner"},
+		{"%% join", RoleAdmin, "Syntax: %% join <#chan>", "missing arguments"},
+		{"%% part", RoleAdmin, "Syntax: %% part <#chan>", "missing arguments"},
+		{"%% nick", RoleAdmin, "Syntax: %% nick <nick>", "missing arguments"},
+		{"%% say #chan", RoleAdmin, "Syntax: %% say <target> <text>", "missing arguments"},
+		{"%% join #chan", RoleAdmin, "join failed: not connected to net", "not connected to net"},
+		{"%% join other/#chan", RoleAdmin, "join failed: no network called other", "no network called other"},
+		{"%% join net/", RoleAdmin, "join failed: no target given", "no target given"},
+		{"%% part #chan bye", RoleAdmin, "part failed: not connected to net", "not connected to net"},
+		{"%% part other/#chan", RoleAdmin, "part failed: no network called other", "no network called other"},
+		{"%% nick 9lives", RoleAdmin, "nick failed: 9lives is not a valid nick", "9lives is not a valid nick"},
+		{"%% nick -zax", RoleAdmin, "nick failed: -zax is not a valid nick", "-zax is not a valid nick"},
+		{"%% nick za,x", RoleAdmin, "nick failed: za,x is not a valid nick", "za,x is not a valid nick"},
+		{"%% nick zax2 other", RoleAdmin, "nick failed: no network called other", "no network called other"},
+		{"%% nick zax2 net", RoleAdmin, "nick failed: not connected to net", "not connected to net"},
+	}
+	for _, test := range tests {
+		ctx := &CommandContext{Zax: zax, ReplyTo: "#admin", Args: strings.Split(test.args, " "), Role: test.role}
+		cmd_admin(ctx)
+		if reply := next_line(t, sent); !strings.HasPrefix(reply, "#admin "+test.reply) {
+			t.Errorf("%q: replied %q, want %q", test.args, reply, test.reply)
+		}
+		switch {
+		case test.err == "" && ctx.Err != nil:
+			t.Errorf("%q: unexpected error %s", test.args, ctx.Err.Error())
+		case test.err != "" && (ctx.Err == nil || ctx.Err.Error() != test.err):
+			t.Errorf("%q: got error %v, want %s", test.args, ctx.Err, test.err)
+		}
+	}
+	if zax.Config.Nickname != "zax" {
+		t.Errorf("a failed nick change set the nick to %s", zax.Config.Nickname)
+	}
+}
+
+func TestJoinReplies(t *testing.T) {
+	zax, sent := test_network("net")
+	defer zax.queue.Stop()
+	tests := []struct {
+		channel string
+		line    *irc.Line // The server's answer.
+		reply   string
+	}{
+		{"#chan", &irc.Line{Cmd: "JOIN", Nick: "zax", Args: []string{"#Chan"}}, "Joined #chan on net."},
+		{"#banned", &irc.Line{Cmd: "474", Args: []string{"zax", "#banned", "Cannot join channel (+b)"}}, "join failed: #banned: Cannot join channel (+b)"},
+		{"#full", &irc.Line{Cmd: "471", Args: []string{"zax", "#FULL", "Cannot join channel (+l)"}}, "join failed: #FULL: Cannot join channel (+l)"},
+		{"#nope", &irc.Line{Cmd: "403", Args: []string{"zax", "#nope", "No such channel"}}, "join failed: #nope: No such channel"},
+	}
+	for _, test := range tests {
+		ctx := &CommandContext{Zax: zax, ReplyTo: "#admin"}
+		zax.await_join(test.channel, join_reply(ctx, zax, test.channel))
+		// Answers about other channels and numerics without a channel are left alone.
+		zax.join_failed(&irc.Line{Cmd: "475", Args: []string{"zax", "#other", "Cannot join channel (+k)"}})
+		zax.join_failed(&irc.Line{Cmd: "405", Args: []string{"zax"}})
+		if test.line.Cmd == "JOIN" {
+			zax.joined_channel(test.line.Target(), nil)
+		} else {
+			zax.join_failed(test.line)
+		}
+		if reply := next_line(t, sent); reply != "#admin "+test.reply {
+			t.Errorf("%s: replied %q, want %q", test.channel, reply, test.reply)
+		}
+		// Only the first answer counts.
+		zax.joined_channel(test.channel, errors.New("late"))
+		select {
+		case line := <-sent:
+			t.Errorf("%s: replied again with %q", test.channel, line)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"audit"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const default_audit_file = "audit.log"
+const audit_page_size = 5
+
+type AuditConfig struct {
+	File   string // Defaults to audit.log.
+	Mirror bool   // Copy every entry to the report channel of the network it happened on.
+}
+
+// Privileged commands, whether they worked or not, and attempts to run them without the role.
+var audit_log *audit.Log
+
+// How many arguments of an admin command are shown in the report channel and the logs.
+// The rest is what the bot was told to send, or a channel key, and can hold passwords.
+var shown_admin_args = map[string]int{
+	"say":  1,
+	"act":  1,
+	"raw":  0,
+	"join": 1,
+}
+
+func (cfg *Config) audit_file() string {
+	if cfg.Audit.File == "" {
+		return default_audit_file
+	}
+	return cfg.Audit.File
+}
+
+func record_audit(ctx *CommandContext, outcome string) {
+	entry := audit.Entry{
+		Network: ctx.Zax.Name,
+		User:    ctx.Sender + "!" + ctx.Line.Ident + "@" + ctx.SenderHost,
+		Account: ctx.Account,
+		Channel: ctx.Channel,
+		Command: strings.Join(ctx.Args, " "),
+		Outcome: outcome,
+	}
+	if audit_log != nil {
+		if err := audit_log.Write(entry); err != nil {
+			log.Errorf("Unable to write to the audit log: %s", err.Error())
+		}
+	}
+	if config.Audit.Mirror && ctx.Zax.Config.ReportChan != "" {
+		entry.Command = strings.Join(redact_command(ctx.Args, ""), " ")
+		ctx.Zax.Privmsg(ctx.Zax.Config.ReportChan, "[audit] "+entry.String())
+	}
+}
+
+func is_admin_token(token string) bool {
+	if commands == nil || token == "" {
+		return false
+	}
+	cmd := commands.Find(token)
+	if cmd == nil {
+		cmd = commands.FindSymbol(token)
+	}
+	return cmd != nil && cmd.Name() == "admin"
+}
+
+// Arguments as Dispatch passes them, e.g. "%% say NickServ identify ...", with what the
+// admin command sends left out. The command may still have the prefix on.
+func redact_command(args []string, prefix string) []string {
+	if len(args) < 2 || !(is_admin_token(args[0]) || prefix != "" && is_admin_token(strings.TrimPrefix(args[0], prefix))) {
+		return args
+	}
+	shown, ok := shown_admin_args[args[1]]
+	if !ok || len(args) <= shown+2 {
+		return args
+	}
+	return append(append([]string{}, args[:shown+2]...), "[redacted]")
+}
+
+// A line as it goes to the log, the history and the report channel, without passwords.
+func redact_line(text, nick, prefix string) string {
+	args := strings.Split(text, " ")
+	if is_login(args, nick, prefix) {
+		return "login ********"
+	}
+	start := 0
+	if len(args) > 1 && addresses(args[0], nick) {
+		start = 1
+	}
+	return strings.Join(append(args[:start:start], redact_command(args[start:], prefix)...), " ")
+}
+
+func admin_audit(ctx *CommandContext, args []string) error {
+	if audit_log == nil {
+		return fmt.Errorf("the audit log isn't open")
+	}
+	page := 1
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("'%s' is not a page number", args[0])
+		}
+		page = n
+	}
+	entries, pages, err := audit_log.Page(page-1, audit_page_size)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		ctx.Reply(fmt.Sprintf("No audit entries on page %d of %d.", page, pages))
+		return nil
+	}
+	ctx.Reply(fmt.Sprintf("Audit log, page %d of %d, newest first:", page, pages))
+	for _, entry := range entries {
+		ctx.Reply(entry.String())
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type Entry struct {
+	Time    int64 // Unix time.
+	Network string
+	User    string // nick!ident@host
+	Account string `json:",omitempty"`
+	Channel string
+	Command string
+	Outcome string // "ok", "denied" or what went wrong.
+}
+
+func (entry Entry) String() string {
+	user := entry.User
+	if entry.Account != "" {
+		user += " (" + entry.Account + ")"
+	}
+	return fmt.Sprintf("[%s] %s/%s %s: %s -- %s", time.Unix(entry.Time, 0).Format("2006-01-02 15:04:05"),
+		entry.Network, entry.Channel, user, entry.Command, entry.Outcome)
+}
+
+// Append-only log with one JSON object per line.
+type Log struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, file: file}, nil
+}
+
+func (log *Log) Write(entry Entry) error {
+	if entry.Time == 0 {
+		entry.Time = time.Now().Unix()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if _, err := log.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return log.file.Sync()
+}
+
+// Page through the log, newest entries first. Page 0 is the most recent one.
+// Also returns the number of pages. Lines that can't be parsed are skipped.
+func (log *Log) Page(page, size int) ([]Entry, int, error) {
+	log.lock.Lock()
+	file, err := os.Open(log.path)
+	log.lock.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	entries := []Entry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := Entry{}
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	pages := (len(entries) + size - 1) / size
+	end := len(entries) - page*size
+	if page < 0 || end <= 0 {
+		return []Entry{}, pages, nil
+	}
+	start := end - size
+	if start < 0 {
+		start = 0
+	}
+	result := []Entry{}
+	for i := end - 1; i >= start; i-- {
+		result = append(result, entries[i])
+	}
+	return result, pages, nil
+}
+
+func (log *Log) Close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return log.file.Close()
+}
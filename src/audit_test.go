@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func core_registry() *CommandRegistry {
+	registry := NewCommandRegistry()
+	register_core_commands(registry)
+	return registry
+}
+
+func TestRedactCommand(t *testing.T) {
+	saved := commands
+	defer func() { commands = saved }()
+	commands = core_registry()
+	// As Dispatch passes them, the name or symbol of the admin command comes first.
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"%% say NickServ identify hunter2", "%% say NickServ [redacted]"},
+		{"admin say NickServ identify hunter2", "admin say NickServ [redacted]"},
+		{"%% act #chan waves", "%% act #chan [redacted]"},
+		{"admin raw PRIVMSG NickServ :identify hunter2", "admin raw [redacted]"},
+		{"%% join #chan key", "%% join #chan [redacted]"},
+		{"%% join #chan", "%% join #chan"},
+		{"%% say #chan", "%% say #chan"},
+		{"%% raw", "%% raw"},
+		{"%% part #chan bye all", "%% part #chan bye all"},
+		{"say NickServ identify hunter2", "say NickServ identify hunter2"},
+		{"help %% raw", "help %% raw"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(redact_command(strings.Split(test.args, " "), ""), " "); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	saved := commands
+	defer func() { commands = saved }()
+	commands = core_registry()
+	tests := []struct {
+		text, prefix string
+		want         string
+	}{
+		{"%% say NickServ identify hunter2", ".", "%% say NickServ [redacted]"},
+		{".admin raw PRIVMSG x :y", ".", ".admin raw [redacted]"},
+		{"zax: %% join #secret key", ".", "zax: %% join #secret [redacted]"},
+		{"zax: admin say #c hi", ".", "zax: admin say #c [redacted]"},
+		{"login hunter2", ".", "login ********"},
+		{"zax: .login name hunter2", ".", "login ********"},
+		{"I said %% say x y", ".", "I said %% say x y"},
+		{"hello there", ".", "hello there"},
+	}
+	for _, test := range tests {
+		if got := redact_line(test.text, "zax", test.prefix); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emersion/go-sasl"
+	irc "github.com/fluffle/goirc/client"
+	"strings"
+	"time"
+)
+
+// How long to wait for services before warning that the channels aren't joined yet.
+const auth_timeout = 30 * time.Second
+
+// Capabilities that tell us which services account users are logged in to, requested
+// whenever the server offers them. sasl is requested by the library when it's configured.
+var wanted_caps = []string{"account-notify", "extended-join", "account-tag"}
+
+type SaslConfig struct {
+	Mechanism string // PLAIN or EXTERNAL, SASL is disabled if empty.
+	Username  string
+	Password  string // Only used with PLAIN.
+}
+
+type NickServConfig struct {
+	Nick     string // Defaults to NickServ.
+	Account  string // Sent with IDENTIFY when the account name differs from the nickname.
+	Password string
+	Recover  string // GHOST or REGAIN to get our nick back from someone else, nothing to just wait for it.
+}
+
+// The SASL client the library authenticates with while registering, nil without SASL.
+// EXTERNAL uses the client certificate the connection was set up with.
+func (net *NetworkConfig) sasl_client() sasl.Client {
+	switch strings.ToUpper(net.Sasl.Mechanism) {
+	case "PLAIN":
+		user := net.Sasl.Username
+		if user == "" {
+			user = net.Nickname
+		}
+		return sasl.NewPlainClient("", user, net.Sasl.Password)
+	case "EXTERNAL":
+		return sasl.NewExternalClient("")
+	}
+	return nil
+}
+
+func (zax *ZAX) uses_sasl() bool {
+	return zax.Config.Sasl.Mechanism != ""
+}
+
+func (zax *ZAX) uses_nickserv() bool {
+	return zax.Config.NickServ.Password != ""
+}
+
+func (zax *ZAX) nickserv() string {
+	if zax.Config.NickServ.Nick != "" {
+		return zax.Config.NickServ.Nick
+	}
+	return "NickServ"
+}
+
+// Join the configured channels once, when we're identified or no authentication is configured.
+func (zax *ZAX) join_channels() {
+	if zax.joined {
+		return
+	}
+	zax.joined = true
+	for i := 0; i < len(zax.Config.Channels); i++ {
+		ch := zax.Config.Channels[i]
+		zax.IrcClient.Join(ch.Chan, ch.Password)
+	}
+}
+
+func (zax *ZAX) authenticated(account string) {
+	if account != "" {
+		log.Noticef("Logged in to %s as %s.", zax.Name, account)
+	}
+	zax.identified = true
+	zax.join_channels()
+}
+
+func (zax *ZAX) nickserv_identify() {
+	ns := zax.Config.NickServ
+	log.Noticef("Identifying with %s on %s.", zax.nickserv(), zax.Name)
+	account := ns.Account
+	if account == "" && !zax.has_nick() {
+		account = zax.Config.Nickname
+	}
+	if account != "" {
+		zax.IrcClient.Privmsg(zax.nickserv(), fmt.Sprintf("IDENTIFY %s %s", account, ns.Password))
+	} else {
+		zax.IrcClient.Privmsg(zax.nickserv(), "IDENTIFY "+ns.Password)
+	}
+	time.AfterFunc(auth_timeout, func() {
+		if !zax.joined {
+			log.Errorf("No answer from %s on %s, the channels are joined once it confirms.", zax.nickserv(), zax.Name)
+		}
+	})
+}
+
+// SASL is negotiated by the library: with capability negotiation enabled it sends CAP LS
+// before NICK and USER, so the server holds registration until SASL is done. If SASL
+// fails, or there's no SASL configured, NickServ IDENTIFY is used after registration.
+// Channels are only joined once one of them succeeded, or when neither is configured.
+func (zax *ZAX) setup_auth(c *irc.Conn) {
+	c.HandleFunc(irc.REGISTER,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			zax.identified = false
+			zax.joined = false
+			zax.sasl_done = !zax.uses_sasl()
+			zax.clear_accounts()
+		}))
+	// RPL_LOGGEDIN, sent for SASL as well as NickServ on most networks.
+	c.HandleFunc("900",
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			account := ""
+			if len(line.Args) > 2 {
+				account = line.Args[2]
+			}
+			if zax.sasl_done {
+				zax.authenticated(account)
+			} else {
+				log.Noticef("Logged in to %s as %s.", zax.Name, account)
+			}
+		}))
+	// RPL_SASLSUCCESS and ERR_SASLALREADY
+	for _, numeric := range []string{"903", "907"} {
+		c.HandleFunc(numeric,
+			locked(func(conn *irc.Conn, line *irc.Line) {
+				log.Noticef("SASL authentication on %s succeeded.", zax.Name)
+				zax.identified = true
+				zax.sasl_done = true
+			}))
+	}
+	// ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+	for _, numeric := range []string{"904", "905", "906"} {
+		c.HandleFunc(numeric,
+			locked(func(conn *irc.Conn, line *irc.Line) {
+				log.Errorf("SASL authentication on %s failed: %s", zax.Name, line.Text())
+				zax.sasl_done = true
+			}))
+	}
+	c.HandleFunc(irc.CONNECTED,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if zax.uses_sasl() && !zax.sasl_done && !conn.HasCapability("sasl") {
+				log.Warningf("%s doesn't support SASL.", zax.Name)
+			}
+			zax.sasl_done = true
+			switch {
+			case zax.identified || !zax.uses_sasl() && !zax.uses_nickserv():
+				zax.join_channels()
+			case zax.uses_nickserv():
+				zax.nickserv_identify()
+			default:
+				log.Errorf("Not joining any channels on %s, we're not logged in.", zax.Name)
+			}
+		}))
+	c.HandleFunc(irc.NOTICE,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if zax.joined || !strings.EqualFold(line.Nick, zax.nickserv()) {
+				return
+			}
+			text := strings.ToLower(line.Text())
+			if strings.Contains(text, "you are now identified") || strings.Contains(text, "password accepted") {
+				zax.authenticated("")
+			}
+			if strings.Contains(text, "invalid password") || strings.Contains(text, "password incorrect") {
+				log.Errorf("%s on %s rejected our password, not joining any channels.", zax.nickserv(), zax.Name)
+			}
+		}))
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"fmt"
+	"games"
+	records "history"
+	"net/url"
+	"news"
+	"query"
+	"search"
+	"steam"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var commands *CommandRegistry
+
+// Commands that are always available, regardless of Config.Handlers.
+func register_core_commands(registry *CommandRegistry) {
+	registry.Register(&SimpleCommand{
+		Trigger: "help",
+		Alias:   []string{"h"},
+		Special: "?h",
+		Help:    "Show help. Syntax: {p}help [ <cmd> ]",
+		Func:    cmd_help,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "login",
+		Help:    "Log in for a role, in a private message only. Syntax: login [ <name> ] <password>",
+		Func:    cmd_login,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "logout",
+		Help:    "End your login session.",
+		Func:    cmd_logout,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "admin",
+		Special: "%%",
+		Help:    "Admin commands. Syntax: %% <cmd> [ <args> ] -- {p}help %% <cmd> for more info.",
+		Topics:  admin_topics(),
+		MinRole: RoleAdmin,
+		Func:    cmd_admin,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "quit",
+		Special: "<<",
+		Help:    "Quit.",
+		MinRole: RoleOwner,
+		Func:    cmd_quit,
+	})
+}
+
+func cmd_help(ctx *CommandContext) {
+	if len(ctx.Args) == 1 {
+		ctx.Reply(commands.HelpSummary(ctx.Role, ctx.Prefix))
+		return
+	}
+	reply_msg := commands.HelpFor(ctx.Args[1:], ctx.Prefix)
+	if reply_msg == "" {
+		return
+	}
+	ctx.Reply(reply_msg)
+}
+
+func cmd_quit(ctx *CommandContext) {
+	if len(ctx.Args) == 1 {
+		quit_all(get_quit_msg())
+	}
+}
+
+// History commands only look at the network the command came from, unless "net:*" or
+// "--all" is given, or another network with "net:<name>". Returns the arguments without
+// those and the network to search, empty for all of them.
+func history_scope(ctx *CommandContext) ([]string, string) {
+	args := []string{}
+	network := ctx.Zax.Name
+	for _, arg := range ctx.Args {
+		switch {
+		case arg == "--all" || arg == "net:*":
+			network = ""
+		case strings.HasPrefix(arg, "net:") && len(arg) > 4:
+			network = arg[4:]
+		default:
+			args = append(args, arg)
+		}
+	}
+	return args, network
+}
+
+func cmd_seen(ctx *CommandContext) {
+	c := ctx.Conn
+	sender := ctx.Sender
+	channel := ctx.Channel
+	args, network := history_scope(ctx)
+	seen_user := strings.TrimPrefix(args[0], "!")
+	if args[0] == "seen" {
+		seen_user = ""
+		if len(args) > 1 {
+			seen_user = args[1]
+		}
+	}
+	if seen_user == "" {
+		log.Debug("No user was specified.")
+		return
+	}
+	if seen_user == sender {
+		log.Debug("Sender same as specified seen user, insult.")
+		ctx.Reply(get_insult())
+	}
+	state := c.StateTracker().GetNick(seen_user)
+	if state != nil {
+		user_channels := state.Channels
+		for i := 0; i < len(ctx.Zax.Config.Channels); i++ {
+			ch := ctx.Zax.Config.Channels[i]
+			_, exists := user_channels[ch.Chan]
+			if exists {
+				if ch.Chan == channel {
+					ctx.Reply(get_insult())
+					log.Notice("seen_user is here now.")
+				} else {
+					sender_state := c.StateTracker().GetNick(sender)
+					_, exists := sender_state.Channels[ch.Chan]
+					if exists {
+						ctx.Reply(seen_user + " is on " + ch.Chan)
+					} else {
+						ctx.Reply("Yeah, somewhere... can't tell you where though.")
+					}
+				}
+			}
+		}
+	}
+	filter := records.Filter{Kind: records.KindMessage, Network: network, User: seen_user}
+	msg, seen_msg := history.Latest(filter)
+	filter.Kind = records.KindEvent
+	evt, seen_evt := history.Latest(filter)
+	if !seen_msg && !seen_evt {
+		ctx.Reply(get_user_not_exists())
+		return
+	}
+	time_seen := time.Time{}
+	action := ""
+	if seen_evt && (!seen_msg || evt.Time >= msg.Time) {
+		time_seen = evt.Timestamp()
+		if evt.Event == "quit" {
+			action = "quitting"
+		}
+		if evt.Event == "join" {
+			action = "joining"
+		}
+	} else {
+		time_seen = msg.Timestamp()
+		action = "writing: \"" + msg.Text + "\""
+	}
+	log.Debugf("Found latest event %s at %d", action, time_seen.Unix())
+
+	duration := time.Since(time_seen)
+	days := 0
+	hours := 0
+	sec := 0
+	min := 0
+
+	log.Debugf("User %s seen hours: %.1f, minutes: %.1f, seconds %.1f ago.", seen_user, duration.Hours(), duration.Minutes(), duration.Seconds())
+
+	if duration.Hours() > 24 {
+		days = int(duration.Hours()) / 24
+		hours = int(duration.Hours()) % 24
+		min = 0
+	} else if duration.Minutes() > 60 {
+		hours = int(duration.Hours())
+		min = int(duration.Minutes()) % 60
+	} else if duration.Seconds() > 60 {
+		min = int(duration.Minutes())
+		sec = int(duration.Seconds()) % 60
+	} else {
+		sec = int(duration.Seconds())
+	}
+
+	times := []string{}
+	if days > 0 {
+		times = append(times, strconv.Itoa(days)+" day(s)")
+	}
+	if hours > 0 {
+		times = append(times, strconv.Itoa(hours)+" hour(s)")
+	}
+	if min > 0 {
+		times = append(times, strconv.Itoa(min)+" minute(s)")
+	}
+	if sec > 0 {
+		times = append(times, strconv.Itoa(sec)+" second(s)")
+	}
+
+	time_str := strings.Join(times, ", ")
+	ctx.Reply(fmt.Sprintf("%s was last seen %s ago %s.", seen_user, time_str, action))
+}
+
+func cmd_game(ctx *CommandContext) {
+	query := ""
+	for i := 1; i < len(ctx.Args); i++ {
+		query += " " + ctx.Args[i]
+	}
+	games, success := games.FindGames(query, games_settings.UserAgent)
+	if success && len(games) > 0 {
+		ctx.Reply(fmt.Sprintf("%s (%s) - %s\n", games[0].Name, games[0].Year, games[0].Url))
+	}
+}
+
+func cmd_url(ctx *CommandContext) {
+	cmd_history(ctx, records.KindUrl)
+}
+
+func cmd_msg(ctx *CommandContext) {
+	cmd_history(ctx, records.KindMessage)
+}
+
+func cmd_event(ctx *CommandContext) {
+	cmd_history(ctx, records.KindEvent)
+}
+
+// <cmd> [ find | last | random ] <search>, see the query package for what a search can have.
+func cmd_history(ctx *CommandContext, kind string) {
+	if len(ctx.Args) < 2 {
+		return
+	}
+	sub := ""
+	switch ctx.Args[1] {
+	case "find", "f":
+		sub = "find"
+	case "last", "latest", "l":
+		sub = "last"
+	case "random", "r":
+		sub = "random"
+	default:
+		ctx.Reply(fmt.Sprintf("Syntax: %s%s [ find | last | random ] <search> -- %shelp %s for more.", ctx.Prefix, ctx.Args[0], ctx.Prefix, ctx.Args[0]))
+		return
+	}
+	q, err := query.Parse(strings.Join(ctx.Args[2:], " "), time.Now())
+	if err != nil {
+		ctx.Reply("Can't search for that: " + err.Error())
+		return
+	}
+	filter := q.Filter
+	filter.Kind = kind
+	if q.AllNetworks {
+		filter.Network = ""
+	} else if filter.Network == "" {
+		filter.Network = ctx.Zax.Name
+	}
+	if seconds := opts.Int("search_seconds", option_scope(ctx.Zax, ctx.Channel)); seconds > 0 {
+		filter.Deadline = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	// Don't find the search itself.
+	if kind == records.KindMessage {
+		filter.Skip = ctx.Logged
+	}
+
+	set := &ResultSet{WithNetwork: filter.Network == ""}
+	if sub == "find" && kind == records.KindMessage && q.Text != "" {
+		words, err := search.Parse(q.Text)
+		if err != nil {
+			ctx.Reply("Can't search for that: " + err.Error())
+			return
+		}
+		order := search.Recent
+		if q.Relevant {
+			order = search.Relevance
+		}
+		filter.Match = func(text string) bool {
+			return (!q.HasUrl || query.ContainsUrl(text)) && q.MatchRegex(text)
+		}
+		found, err := search_messages(words, filter, order)
+		if err != nil {
+			history_failed(ctx, err)
+			return
+		}
+		for i := 0; i < len(found) && i < result_limit; i++ {
+			set.Records = append(set.Records, found[i])
+		}
+		set.Total = len(found)
+	} else {
+		if len(q.Words) > 0 || len(q.Exclude) > 0 || q.HasUrl || q.Regex != nil {
+			filter.Match = func(text string) bool {
+				return q.Match(text) && q.MatchRegex(text)
+			}
+		}
+		if sub == "random" {
+			// Just the one, but it's kept for context.
+			record, found, err := history.store.Random(filter)
+			switch {
+			case err != nil:
+				history_failed(ctx, err)
+			case found:
+				set.Records, set.Total = []records.Record{record}, 1
+				results.put(result_key(ctx), set)
+				ctx.Reply(format_record(record, set.WithNetwork))
+			default:
+				ctx.Reply("Nothing found.")
+			}
+			return
+		}
+		if set.Records, err = history.store.Search(filter, result_limit); err == nil {
+			set.Total, err = history.store.Count(filter)
+		}
+		if err != nil {
+			history_failed(ctx, err)
+			return
+		}
+	}
+	show_results(ctx, set)
+}
+
+func history_failed(ctx *CommandContext, err error) {
+	switch err {
+	case records.ErrDeadline:
+		ctx.Reply("That search took too long, narrow it down with from:, in: or since:.")
+		return
+	case search.ErrOnlyNot:
+		ctx.Reply("Can't search for that: " + err.Error())
+		return
+	}
+	log.Errorf("History query failed: %s", err.Error())
+}
+
+func cmd_random(ctx *CommandContext) {
+	args := ctx.Args
+	if len(args) < 3 {
+		return
+	}
+	min, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil {
+		log.Debug("Failed to parse min.")
+		return
+	}
+	max, err := strconv.ParseInt(args[2], 10, 32)
+	if err != nil {
+		log.Debug("Failed to parse max.")
+		return
+	}
+	if min > max {
+		return
+	}
+	ctx.Reply("What about... " + strconv.Itoa(rand_int(int(min), int(max))))
+}
+
+const max_steam_term = 100
+
+func cmd_steam(ctx *CommandContext) {
+	args := ctx.Args
+	if len(args) < 2 {
+		return
+	}
+	subcommand := args[1]
+	success := false
+	steam_appid := 0
+	var err error
+
+	steam_latest_url := "http://store.steampowered.com/search/?sort_by=Released_DESC&tags=-1&category1=998&page="
+
+	if subcommand == "latest" || subcommand == "l" {
+		steam_appid, success = steam.SearchSteampowered(steam_latest_url+"1", 0)
+	}
+	if subcommand == "random" || subcommand == "r" {
+		page := strconv.Itoa(rand_int(1, steam_settings.RandomPages+1))
+		steam_appid, success = steam.SearchSteampowered(steam_latest_url+page, -2)
+	}
+	if subcommand == "trending" || subcommand == "t" {
+		apps, suc := steam.GetTrending(steam_settings.UserAgent)
+		if suc && len(apps) > 0 {
+			app := apps[0]
+			ctx.Reply(fmt.Sprintf("[Steamcharts] %s [%s increase in players last 24h] %d current players. Type '%ss a %d' to get more info.", app.Name, app.Increase, app.Players, ctx.Prefix, app.Id))
+			return
+		}
+	}
+
+	if (subcommand == "appid" || subcommand == "a") && len(args) > 2 {
+		steam_appid, err = strconv.Atoi(args[2])
+		success = (err == nil)
+	}
+	if subcommand == "find" || subcommand == "f" {
+		// Searched for as it is, steam does its own matching.
+		term := strings.TrimSpace(strings.Join(args[2:], " "))
+		if term == "" || len(term) > max_steam_term {
+			ctx.Reply(fmt.Sprintf("Syntax: %ss find <name> -- up to %d characters.", ctx.Prefix, max_steam_term))
+			return
+		}
+		log.Debugf("search term: %s", term)
+		search_url := "http://store.steampowered.com/search/?snr=&term=" + url.QueryEscape(term)
+		log.Debugf("Search URL: %s", search_url)
+		steam_appid, success = steam.SearchSteampowered(search_url, 0)
+	}
+	if success {
+		log.Infof("Found appid %d, retrieving info...", steam_appid)
+		app, success2 := steam.GetAppInfo(steam_appid, steam_settings.UserAgent)
+		if success2 {
+			ctx.Reply(steam_info(app))
+		} else {
+			log.Error("Failed to retrieve steamapp info.")
+		}
+
+	} else {
+		log.Notice("Failed to retrieve appid from search.")
+	}
+}
+
+func steam_info(app steam.SteamApp) string {
+	rating_str := ""
+	if app.Reviews > 0 {
+		rating_str = fmt.Sprintf("| %.1f%s rating (%d reviews)", app.Rating, "%", app.Reviews)
+	}
+	os_str := ""
+	if app.OS("") != "" {
+		os_str = fmt.Sprintf("%s - [%s]", app.OS("/"), app.Features("/"))
+	}
+	price := ""
+	if app.PriceDiscount != "" {
+		price = "| " + app.PriceDiscount
+	} else {
+		if app.Price != "" {
+			price = "| " + app.Price
+		}
+	}
+	base_str := ""
+	if app.ReleaseYear != "" && app.Developer != "" {
+		base_str = fmt.Sprintf("(%s by \"%s\")", app.ReleaseYear, app.Developer)
+	}
+	return fmt.Sprintf("[http://steamspy.com/app/%d/] \"%s\" %s %s %s %s", app.Id, app.Name, base_str, os_str, rating_str, price)
+}
+
+var news_poller *news.Poller
+
+func format_news(item news.Item) string {
+	return fmt.Sprintf("[%s] %s - %s", item.Feed, item.Title, item.Link)
+}
+
+// News goes to the channels listed in the news settings, either as "#chan" for that channel
+// on every network or "network/#chan" for a single one. Without a list it goes everywhere.
+func announce_news(item news.Item) {
+	log.Infof("Announcing news item %s", item.Id)
+	config_lock.RLock()
+	defer config_lock.RUnlock()
+	for _, zax := range networks {
+		for _, ch := range zax.Config.Channels {
+			if len(news_settings.Channels) > 0 && !channel_listed(news_settings.Channels, zax.Name, ch.Chan) {
+				continue
+			}
+			zax.Privmsg(ch.Chan, format_news(item))
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func cmd_news(ctx *CommandContext) {
+	if news_poller == nil {
+		return
+	}
+	count := news_settings.Count
+	if len(ctx.Args) > 1 {
+		n, err := strconv.Atoi(ctx.Args[1])
+		if err == nil && n > 0 && n <= 10 {
+			count = n
+		}
+	}
+	items := news_poller.Latest(count)
+	if len(items) == 0 {
+		ctx.Reply("No news.")
+		return
+	}
+	for _, item := range items {
+		ctx.Reply(format_news(item))
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	irc "github.com/fluffle/goirc/client"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var config_path = "conf.json"
+
+// Compiled form of Config.Admin, kept for configs from before Roles.
+type AdminRule struct {
+	Field string // nick or host
+	Expr  *regexp.Regexp
+}
+
+func parse_admin_rule(admin string) (*AdminRule, error) {
+	if admin == "" {
+		return nil, nil
+	}
+	criteria := regexp.MustCompile("^(nick|host):(.+)$").FindStringSubmatch(admin)
+	if criteria == nil {
+		return nil, fmt.Errorf("Admin must look like nick:<expr> or host:<expr>, got '%s'", admin)
+	}
+	expr, err := regexp.Compile(criteria[2])
+	if err != nil {
+		return nil, fmt.Errorf("Admin has an invalid expression: %s", err.Error())
+	}
+	return &AdminRule{criteria[1], expr}, nil
+}
+
+// YAML decodes nested maps with interface{} keys, which encoding/json can't marshal.
+func yaml_to_json(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, item := range v {
+			m[fmt.Sprint(key)] = yaml_to_json(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yaml_to_json(item)
+		}
+	}
+	return value
+}
+
+// YAML and TOML configs are converted to JSON first, so every format goes through the same
+// decoding, including the json.RawMessage module settings.
+func config_json(path string, data []byte) ([]byte, error) {
+	var tree interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+		tree = yaml_to_json(tree)
+	case ".toml":
+		m := make(map[string]interface{})
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+		tree = m
+	default:
+		return data, nil
+	}
+	return json.Marshal(tree)
+}
+
+// Secrets can be written as "env:NAME" to read them from the environment instead,
+// so the config file can be committed without them.
+func resolve_secret(value string) (string, error) {
+	if !strings.HasPrefix(value, "env:") {
+		return value, nil
+	}
+	name := strings.TrimPrefix(value, "env:")
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return secret, nil
+}
+
+func (net *NetworkConfig) resolve_secrets() error {
+	var err error
+	for i := range net.Channels {
+		if net.Channels[i].Password, err = resolve_secret(net.Channels[i].Password); err != nil {
+			return err
+		}
+	}
+	if net.Sasl.Password, err = resolve_secret(net.Sasl.Password); err != nil {
+		return err
+	}
+	if net.NickServ.Password, err = resolve_secret(net.NickServ.Password); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cfg *Config) resolve_secrets() error {
+	if err := cfg.NetworkConfig.resolve_secrets(); err != nil {
+		return err
+	}
+	for i := range cfg.Networks {
+		if err := cfg.Networks[i].resolve_secrets(); err != nil {
+			return fmt.Errorf("network %s: %s", cfg.Networks[i].Name, err.Error())
+		}
+	}
+	return nil
+}
+
+func load_config(path string) (Config, error) {
+	cfg := Config{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	data, err = config_json(path, data)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if err := cfg.resolve_secrets(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// Check everything that would otherwise only blow up once the bot is running.
+// All problems are reported at once.
+func (cfg *Config) Validate() error {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, err := parse_admin_rule(cfg.Admin); err != nil {
+		add("%s", err.Error())
+	}
+	for _, rc := range cfg.Roles {
+		if _, err := compile_role(rc); err != nil {
+			add("%s", err.Error())
+		}
+	}
+	login_names := make(map[string]bool)
+	for i, login := range cfg.Logins {
+		// Only one hash is checked per attempt, so the name has to pick the login.
+		if login_names[login.Name] {
+			if login.Name == "" {
+				add("login %d: only one login can be without a Name", i+1)
+			} else {
+				add("login %d: there is already a login called %s", i+1, login.Name)
+			}
+		}
+		login_names[login.Name] = true
+		if _, _, _, err := parse_hash(login.Hash); err != nil {
+			add("login %d: %s", i+1, err.Error())
+		}
+		if role, ok := parse_role(login.Role); !ok || role == RoleUser {
+			add("login %d: Role has to be trusted, admin or owner", i+1)
+		}
+	}
+	if cfg.ReconnectMin < 0 || cfg.ReconnectMax < 0 {
+		add("ReconnectMin and ReconnectMax can't be negative")
+	}
+	if cfg.Cooldown.Warn < 0 {
+		add("Cooldown.Warn can't be negative")
+	}
+	switch cfg.History.Store {
+	case "", "file", "sqlite":
+	default:
+		add("History.Store has to be file or sqlite")
+	}
+	if cfg.Output.MaxLines < 0 {
+		add("Output.MaxLines can't be negative")
+	}
+
+	nets := cfg.Networks
+	if len(nets) == 0 {
+		nets = []NetworkConfig{cfg.NetworkConfig}
+		if nets[0].Name == "" {
+			nets[0].Name = "default"
+		}
+	}
+	names := make(map[string]bool)
+	for i, net := range nets {
+		where := fmt.Sprintf("network %d", i+1)
+		if net.Name == "" {
+			add("%s has no Name", where)
+		} else {
+			where = "network " + net.Name
+			if names[net.Name] {
+				add("%s is configured twice", where)
+			}
+			if strings.ContainsAny(net.Name, "/: ") {
+				add("%s: Name can't contain '/', ':' or spaces", where)
+			}
+			names[net.Name] = true
+		}
+		if net.Nickname == "" {
+			add("%s has no Nickname", where)
+		}
+		if net.Server == "" && len(net.Servers) == 0 {
+			add("%s has no Server", where)
+		}
+		for _, ch := range net.Channels {
+			if ch.Chan == "" || !strings.ContainsAny(ch.Chan[:1], "#&+!") {
+				add("%s: '%s' is not a channel name", where, ch.Chan)
+			}
+		}
+		switch strings.ToUpper(net.Sasl.Mechanism) {
+		case "":
+		case "PLAIN":
+			if net.Sasl.Password == "" {
+				add("%s: SASL PLAIN needs a Password", where)
+			}
+		case "EXTERNAL":
+			if net.CertFile == "" || !net.SSL {
+				add("%s: SASL EXTERNAL needs SSL and a CertFile", where)
+			}
+		default:
+			add("%s: unknown SASL mechanism '%s'", where, net.Sasl.Mechanism)
+		}
+		if (net.CertFile == "") != (net.KeyFile == "") {
+			add("%s: CertFile and KeyFile have to be set together", where)
+		}
+		switch strings.ToUpper(net.NickServ.Recover) {
+		case "", "GHOST", "REGAIN":
+		default:
+			add("%s: NickServ.Recover has to be GHOST or REGAIN", where)
+		}
+	}
+
+	for _, name := range cfg.Handlers {
+		if find_module(name) == nil {
+			add("unknown handler '%s'", name)
+		}
+	}
+	for name, raw := range cfg.Modules {
+		module := find_module(name)
+		if module == nil {
+			add("settings for unknown handler '%s'", name)
+			continue
+		}
+		if module.Settings == nil {
+			continue
+		}
+		settings := reflect.New(reflect.TypeOf(module.Settings).Elem()).Interface()
+		if err := json.Unmarshal(raw, settings); err != nil {
+			add("invalid settings for handler '%s': %s", name, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Reloads asked for by "%% reload", main runs them and calls back with the result,
+// with the config read locked.
+var reload_requests = make(chan func(changes []string, err error), 1)
+
+// Keeps handlers from seeing a config that's halfway applied. IRC handlers and the news
+// announcements hold it for reading, reload_config for writing.
+var config_lock sync.RWMutex
+
+// Runs an IRC handler with the config read locked.
+func locked(handler irc.HandlerFunc) irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		config_lock.RLock()
+		defer config_lock.RUnlock()
+		handler(conn, line)
+	}
+}
+
+// Apply a new config: compiles the roles and loads the modules first, then switches everything
+// over to them, so a config that fails to load changes nothing. Called with config_lock held,
+// or before anything that uses the config runs.
+func apply_config(cfg Config) error {
+	grants, err := compile_roles(&cfg)
+	if err != nil {
+		return err
+	}
+	loaded, err := load_modules(&cfg)
+	if err != nil {
+		return err
+	}
+	config = cfg
+	role_grants = grants
+	loaded.use()
+	define_options()
+	return nil
+}
+
+func diff_lists(old, neu []string) (added, removed []string) {
+	for _, s := range neu {
+		if !contains(old, s) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range old {
+		if !contains(neu, s) {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+func describe_diff(what string, old, neu []string) []string {
+	added, removed := diff_lists(old, neu)
+	changes := []string{}
+	for _, s := range added {
+		changes = append(changes, fmt.Sprintf("%s +%s", what, s))
+	}
+	for _, s := range removed {
+		changes = append(changes, fmt.Sprintf("%s -%s", what, s))
+	}
+	return changes
+}
+
+func channel_names(channels []ChannelCredentials) []string {
+	names := []string{}
+	for _, ch := range channels {
+		names = append(names, ch.Chan)
+	}
+	return names
+}
+
+func enabled_module_names() []string {
+	names := []string{}
+	for name, enabled := range enabled_modules {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Re-read the config file and apply it without reconnecting. Returns what changed;
+// things that can only change with a restart are reported but left alone.
+func reload_config() ([]string, error) {
+	cfg, err := load_config(config_path)
+	if err != nil {
+		return nil, err
+	}
+	config_lock.Lock()
+	defer config_lock.Unlock()
+	old := config
+	old_modules := enabled_module_names()
+	if err := apply_config(cfg); err != nil {
+		return nil, err
+	}
+	changes := describe_diff("handler", old_modules, enabled_module_names())
+	if old.Admin != cfg.Admin {
+		changes = append(changes, "admin rule")
+	}
+	if !reflect.DeepEqual(old.Roles, cfg.Roles) {
+		changes = append(changes, "roles")
+	}
+	if old.ProcessUrls != cfg.ProcessUrls {
+		changes = append(changes, fmt.Sprintf("process_urls %t", cfg.ProcessUrls))
+	}
+	if old.UserAgent != cfg.UserAgent {
+		changes = append(changes, "user agent")
+	}
+	changes = append(changes, describe_diff("feed", old.News, cfg.News)...)
+	if old.History.Store != cfg.History.Store || old.History.Database != cfg.History.Database {
+		changes = append(changes, "history store (needs restart)")
+	}
+	if old.History.IndexLimit != cfg.History.IndexLimit {
+		changes = append(changes, "index limit (from the next reindex)")
+	}
+	if !reflect.DeepEqual(old.Cooldown, cfg.Cooldown) {
+		changes = append(changes, "cooldowns")
+		cooldowns.Reset()
+	}
+	if old.Flood != cfg.Flood {
+		changes = append(changes, "flood limits")
+		for _, zax := range networks {
+			zax.apply_flood_config(config.FloodLimits())
+		}
+	}
+
+	nets := network_configs()
+	for _, net := range nets {
+		zax := find_network(net.Name)
+		if zax == nil {
+			changes = append(changes, fmt.Sprintf("network %s added (needs restart)", net.Name))
+			continue
+		}
+		changes = append(changes, zax.apply_config(net)...)
+	}
+	for _, zax := range networks {
+		found := false
+		for _, net := range nets {
+			found = found || net.Name == zax.Name
+		}
+		if !found {
+			changes = append(changes, fmt.Sprintf("network %s removed (needs restart)", zax.Name))
+		}
+	}
+	log.Noticef("Config reloaded: %s", strings.Join(changes, ", "))
+	return changes, nil
+}
+
+// Apply the parts of a network's config that can change while connected.
+func (zax *ZAX) apply_config(net NetworkConfig) []string {
+	old := zax.Config
+	zax.Config = net
+	changes := []string{}
+	prefix := zax.Name + ": "
+
+	added, removed := diff_lists(channel_names(old.Channels), channel_names(net.Channels))
+	for _, ch := range net.Channels {
+		if contains(added, ch.Chan) && zax.joined {
+			zax.IrcClient.Join(ch.Chan, ch.Password)
+		}
+	}
+	for _, ch := range removed {
+		if zax.joined {
+			zax.IrcClient.Part(ch)
+		}
+	}
+	for _, change := range describe_diff("channel", channel_names(old.Channels), channel_names(net.Channels)) {
+		changes = append(changes, prefix+change)
+	}
+	if old.Nickname != net.Nickname {
+		changes = append(changes, prefix+"nickname "+net.Nickname)
+		zax.reclaim_nick()
+	}
+	if old.ReportChan != net.ReportChan {
+		changes = append(changes, prefix+"report channel")
+	}
+	if !reflect.DeepEqual(old.Servers, net.Servers) || old.Server != net.Server {
+		changes = append(changes, prefix+"servers (used on next reconnect)")
+	}
+	if !reflect.DeepEqual(old.Sasl, net.Sasl) || !reflect.DeepEqual(old.NickServ, net.NickServ) {
+		changes = append(changes, prefix+"authentication (used on next reconnect)")
+	}
+	if old.SSL != net.SSL || old.SSLIgnoreInsecure != net.SSLIgnoreInsecure || old.CertFile != net.CertFile ||
+		old.KeyFile != net.KeyFile || old.Username != net.Username {
+		changes = append(changes, prefix+"connection settings (needs restart)")
+		// Keep what the connection was set up with, so the rest of the code agrees with it.
+		zax.Config.SSL = old.SSL
+		zax.Config.SSLIgnoreInsecure = old.SSLIgnoreInsecure
+		zax.Config.CertFile = old.CertFile
+		zax.Config.KeyFile = old.KeyFile
+		zax.Config.Username = old.Username
+	}
+	return changes
+}
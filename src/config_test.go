@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"options"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func init() {
+	logging.SetLevel(logging.ERROR, "")
+}
+
+func test_config(handlers []string, modules map[string]string) Config {
+	cfg := Config{Handlers: handlers, Modules: make(map[string]json.RawMessage), UserAgent: "test"}
+	cfg.Nickname = "zax"
+	cfg.Server = "irc.example.com:6667"
+	for name, settings := range modules {
+		cfg.Modules[name] = json.RawMessage(settings)
+	}
+	return cfg
+}
+
+func TestApplyConfig(t *testing.T) {
+	opts = options.Load(filepath.Join(t.TempDir(), "options.json"))
+	if err := apply_config(test_config([]string{"steam", "news"}, map[string]string{"steam": `{"RandomPages": 10}`})); err != nil {
+		t.Fatal(err)
+	}
+	if !module_enabled("steam") || module_enabled("games") {
+		t.Errorf("enabled modules = %v, want steam and news", enabled_module_names())
+	}
+	if steam_settings.RandomPages != 10 || steam_settings.UserAgent != "test" {
+		t.Errorf("steam settings = %+v, want RandomPages 10 and the default user agent", steam_settings)
+	}
+	if commands.Find("s") == nil || commands.Find("g") != nil {
+		t.Error("the commands don't match the enabled modules")
+	}
+
+	// A config that fails to load leaves everything as it was.
+	tests := []Config{
+		test_config([]string{"games"}, map[string]string{"games": `{"UserAgent": 5}`}),
+		test_config([]string{"games", "nonsense"}, nil),
+		func() Config {
+			cfg := test_config([]string{"games"}, nil)
+			cfg.Roles = []RoleConfig{{Role: "nonsense"}}
+			return cfg
+		}(),
+	}
+	for i, cfg := range tests {
+		if err := apply_config(cfg); err == nil {
+			t.Errorf("config %d: no error", i+1)
+		}
+		if names := strings.Join(enabled_module_names(), ","); names != "news,steam" {
+			t.Errorf("config %d: enabled modules = %s, want news,steam", i+1, names)
+		}
+		if steam_settings.RandomPages != 10 || games_settings.UserAgent != "test" {
+			t.Errorf("config %d: settings changed to %+v, %+v", i+1, steam_settings, games_settings)
+		}
+		if commands.Find("s") == nil || commands.Find("g") != nil {
+			t.Errorf("config %d: the commands changed", i+1)
+		}
+		if len(config.Handlers) != 2 {
+			t.Errorf("config %d: config changed to handlers %v", i+1, config.Handlers)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		change  func(cfg *Config)
+		problem string
+	}{
+		{func(cfg *Config) {}, ""},
+		{func(cfg *Config) { cfg.Admin = "nick:(" }, "Admin has an invalid expression"},
+		{func(cfg *Config) { cfg.Nickname = "" }, "has no Nickname"},
+		{func(cfg *Config) { cfg.Channels = []ChannelCredentials{{Chan: "nochan"}} }, "'nochan' is not a channel name"},
+		{func(cfg *Config) { cfg.Sasl.Mechanism = "PLAIN" }, "SASL PLAIN needs a Password"},
+		{func(cfg *Config) { cfg.Sasl.Mechanism = "EXTERNAL" }, "SASL EXTERNAL needs SSL and a CertFile"},
+		{func(cfg *Config) { cfg.Handlers = []string{"nonsense"} }, "unknown handler 'nonsense'"},
+		{func(cfg *Config) { cfg.Modules["steam"] = json.RawMessage(`[]`) }, "invalid settings for handler 'steam'"},
+		{func(cfg *Config) { cfg.History.Store = "mysql" }, "History.Store has to be file or sqlite"},
+		{func(cfg *Config) { cfg.Logins = []LoginConfig{{Role: "admin"}, {Role: "owner"}} }, "only one login can be without a Name"},
+		{func(cfg *Config) {
+			cfg.Logins = []LoginConfig{{Name: "a", Role: "admin"}, {Name: "a", Role: "owner"}}
+		}, "there is already a login called a"},
+		{func(cfg *Config) {
+			cfg.Networks = []NetworkConfig{{Name: "a", Nickname: "zax", Server: "a:6667"}, {Name: "a", Nickname: "zax", Server: "b:6667"}}
+		}, "network a is configured twice"},
+	}
+	for i, test := range tests {
+		cfg := test_config(nil, nil)
+		test.change(&cfg)
+		err := cfg.Validate()
+		switch {
+		case test.problem == "" && err != nil:
+			t.Errorf("config %d: unexpected error %s", i+1, err.Error())
+		case test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)):
+			t.Errorf("config %d: got %v, want an error about %s", i+1, err, test.problem)
+		}
+	}
+}
+
+func TestReloadIsLeftToMain(t *testing.T) {
+	if err := admin_reload(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin_reload(nil, nil); err == nil {
+		t.Error("a second reload was queued before main ran the first")
+	}
+	select {
+	case <-reload_requests:
+	default:
+		t.Fatal("no reload was queued")
+	}
+}
+
+func TestUpdateNews(t *testing.T) {
+	opts = options.Load(filepath.Join(t.TempDir(), "options.json"))
+	state := filepath.Join(t.TempDir(), "news.json")
+	apply := func(handlers []string, feeds []string, interval int) {
+		t.Helper()
+		cfg := test_config(handlers, map[string]string{"news": fmt.Sprintf(`{"State": %q, "Interval": %d}`, state, interval)})
+		cfg.News = feeds
+		if err := apply_config(cfg); err != nil {
+			t.Fatal(err)
+		}
+		update_news()
+	}
+	defer func() {
+		apply(nil, nil, 0)
+	}()
+	// Nothing listens there, every poll fails quickly.
+	feeds := []string{"http://127.0.0.1:1/feed"}
+
+	apply([]string{"news"}, feeds, 5)
+	first := news_poller
+	if first == nil {
+		t.Fatal("no poller with news enabled")
+	}
+	apply([]string{"news", "steam"}, feeds, 5)
+	if news_poller != first {
+		t.Error("the poller was replaced though the news settings didn't change")
+	}
+	apply([]string{"news"}, feeds, 10)
+	if news_poller == first || news_poller == nil {
+		t.Error("the poller wasn't replaced after the interval changed")
+	}
+	apply([]string{"news"}, nil, 10)
+	if news_poller != nil {
+		t.Error("the poller still runs without feeds")
+	}
+	apply([]string{"steam"}, feeds, 10)
+	if news_poller != nil {
+		t.Error("the poller runs with the news module disabled")
+	}
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	t.Setenv("ZAX_TEST_KEY", "sekrit")
+	files := map[string]string{
+		"zax.json": `{
+			"Nickname": "zax", "Server": "irc.example.com:6697", "SSL": true,
+			"Channels": [{"Chan": "#a"}, {"Chan": "#b", "Password": "env:ZAX_TEST_KEY"}],
+			"Handlers": ["steam"],
+			"Modules": {"steam": {"RandomPages": 3, "Tags": {"co-op": 1}}},
+			"Networks": [{"Name": "other", "Nickname": "zax2", "Server": "irc.other.net:6667"}]
+		}`,
+		"zax.yaml": `
+Nickname: zax
+Server: irc.example.com:6697
+SSL: true
+Channels:
+  - Chan: "#a"
+  - Chan: "#b"
+    Password: env:ZAX_TEST_KEY
+Handlers: [steam]
+Modules:
+  steam:
+    RandomPages: 3
+    Tags:
+      co-op: 1
+Networks:
+  - Name: other
+    Nickname: zax2
+    Server: irc.other.net:6667
+`,
+		"zax.TOML": `
+Nickname = "zax"
+Server = "irc.example.com:6697"
+SSL = true
+Handlers = ["steam"]
+
+[[Channels]]
+Chan = "#a"
+
+[[Channels]]
+Chan = "#b"
+Password = "env:ZAX_TEST_KEY"
+
+[Modules.steam]
+RandomPages = 3
+
+[Modules.steam.Tags]
+co-op = 1
+
+[[Networks]]
+Name = "other"
+Nickname = "zax2"
+Server = "irc.other.net:6667"
+`,
+	}
+	dir := t.TempDir()
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := load_config(path)
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+			continue
+		}
+		if cfg.Nickname != "zax" || cfg.Server != "irc.example.com:6697" || !cfg.SSL {
+			t.Errorf("%s: got nick %s, server %s, SSL %t", name, cfg.Nickname, cfg.Server, cfg.SSL)
+		}
+		if want := []ChannelCredentials{{"#a", ""}, {"#b", "sekrit"}}; !reflect.DeepEqual(cfg.Channels, want) {
+			t.Errorf("%s: got channels %+v, want %+v", name, cfg.Channels, want)
+		}
+		if len(cfg.Networks) != 1 || cfg.Networks[0].Name != "other" || cfg.Networks[0].Server != "irc.other.net:6667" {
+			t.Errorf("%s: got networks %+v", name, cfg.Networks)
+		}
+		// Module settings stay raw JSON, whatever the format of the file.
+		var steam struct {
+			RandomPages int
+			Tags        map[string]int
+		}
+		if err := json.Unmarshal(cfg.Modules["steam"], &steam); err != nil || steam.RandomPages != 3 || steam.Tags["co-op"] != 1 {
+			t.Errorf("%s: got steam settings %s (%v)", name, cfg.Modules["steam"], err)
+		}
+	}
+
+	broken := map[string]string{"broken.yaml": "Nickname: [zax", "broken.toml": "Nickname = ", "broken.json": "{"}
+	for name, text := range broken {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := load_config(path); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%s: got %v, want an error naming the file", name, err)
+		}
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("ZAX_TEST_SECRET", "hunter2")
+	t.Setenv("ZAX_TEST_EMPTY", "")
+	tests := []struct {
+		value, want, problem string
+	}{
+		{"plain", "plain", ""},
+		{"", "", ""},
+		{"env:ZAX_TEST_SECRET", "hunter2", ""},
+		{"env:ZAX_TEST_EMPTY", "", ""},
+		{"ENV:ZAX_TEST_SECRET", "ENV:ZAX_TEST_SECRET", ""},
+		{"env:ZAX_TEST_UNSET", "", "environment variable ZAX_TEST_UNSET is not set"},
+	}
+	for _, test := range tests {
+		got, err := resolve_secret(test.value)
+		switch {
+		case test.problem == "" && (err != nil || got != test.want):
+			t.Errorf("%q: got %q, %v, want %q", test.value, got, err, test.want)
+		case test.problem != "" && (err == nil || err.Error() != test.problem):
+			t.Errorf("%q: got %v, want an error about %s", test.value, err, test.problem)
+		}
+	}
+
+	// Every password of every network is looked up, and an unset one fails the load.
+	cfg := test_config(nil, nil)
+	cfg.Sasl.Password = "env:ZAX_TEST_SECRET"
+	cfg.Networks = []NetworkConfig{{Name: "other", NickServ: NickServConfig{Password: "env:ZAX_TEST_UNSET"}}}
+	if err := cfg.resolve_secrets(); err == nil || !strings.Contains(err.Error(), "ZAX_TEST_UNSET") {
+		t.Errorf("got %v, want an error about ZAX_TEST_UNSET", err)
+	}
+	if cfg.Sasl.Password != "hunter2" {
+		t.Errorf("SASL password = %q, want hunter2", cfg.Sasl.Password)
+	}
+}
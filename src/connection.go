@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	default_reconnect_min = 5   // seconds
+	default_reconnect_max = 600 // seconds
+)
+
+// Delay before reconnect attempt number n (starting at 0), doubling from min up to max
+// with up to 50% random jitter so several bots don't hammer the server in lockstep.
+func backoff_delay(attempt int, min, max time.Duration) time.Duration {
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay + jitter
+}
+
+// Servers to rotate through, Servers or Server if there's no list.
+func (zax *ZAX) server_list() []string {
+	if len(zax.Config.Servers) > 0 {
+		return zax.Config.Servers
+	}
+	return []string{zax.Config.Server}
+}
+
+func all_quitting() bool {
+	for _, zax := range networks {
+		if !zax.is_quitting() {
+			return false
+		}
+	}
+	return true
+}
+
+func reconnect_delays() (time.Duration, time.Duration) {
+	min := config.ReconnectMin
+	max := config.ReconnectMax
+	if min <= 0 {
+		min = default_reconnect_min
+	}
+	if max < min {
+		max = default_reconnect_max
+	}
+	if max < min {
+		max = min
+	}
+	return time.Duration(min) * time.Second, time.Duration(max) * time.Second
+}
+
+// Try the configured servers in turn until one of them accepts the connection,
+// waiting longer between each failed attempt. The attempt counter is reset once
+// the server has welcomed us, so a connection that drops during registration backs off too.
+// If we quit in the meantime, main is told through disconnected like after a disconnect.
+func (zax *ZAX) ConnectLoop() {
+	config_lock.RLock()
+	servers := zax.server_list()
+	min, max := reconnect_delays()
+	config_lock.RUnlock()
+	for {
+		zax.conn_lock.Lock()
+		attempts := zax.attempts
+		zax.conn_lock.Unlock()
+		if attempts > 0 {
+			delay := backoff_delay(attempts-1, min, max)
+			log.Noticef("Reconnecting to %s in %.0f seconds.", zax.Name, delay.Seconds())
+			select {
+			case <-time.After(delay):
+			case <-zax.quit:
+			}
+		}
+		zax.conn_lock.Lock()
+		if zax.quitting {
+			zax.conn_lock.Unlock()
+			zax.disconnected <- zax
+			return
+		}
+		zax.attempts++
+		attempts = zax.attempts
+		zax.conn_lock.Unlock()
+
+		server := servers[zax.server_index%len(servers)]
+		zax.server_index++
+		zax.IrcConfig.Server = server
+		log.Noticef("Connecting to %s on %s (attempt %d).", zax.Name, server, attempts)
+		err := zax.IrcClient.Connect()
+		if err == nil {
+			if zax.is_quitting() {
+				// The quit came while we were connecting, the server never saw it.
+				zax.IrcClient.Quit(get_quit_msg())
+			}
+			return
+		}
+		log.Errorf("Connection to %s failed: %s", server, err.Error())
+	}
+}
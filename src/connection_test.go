@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	min, max := 5*time.Second, 60*time.Second
+	tests := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, 60 * time.Second},
+		{10, 60 * time.Second},
+		{1000, 60 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 50; i++ {
+			delay := backoff_delay(test.attempt, min, max)
+			if delay < test.base || delay > test.base+test.base/2 {
+				t.Errorf("attempt %d: delay %s, want %s plus up to 50%%", test.attempt, delay, test.base)
+				break
+			}
+		}
+	}
+}
+
+func TestReconnectDelays(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	tests := []struct {
+		min, max           int
+		want_min, want_max time.Duration
+	}{
+		{0, 0, default_reconnect_min * time.Second, default_reconnect_max * time.Second},
+		{10, 30, 10 * time.Second, 30 * time.Second},
+		{10, 0, 10 * time.Second, default_reconnect_max * time.Second},
+		{1000, 0, 1000 * time.Second, 1000 * time.Second},
+	}
+	for _, test := range tests {
+		config.ReconnectMin, config.ReconnectMax = test.min, test.max
+		min, max := reconnect_delays()
+		if min != test.want_min || max != test.want_max {
+			t.Errorf("ReconnectMin %d, ReconnectMax %d: got %s and %s, want %s and %s",
+				test.min, test.max, min, max, test.want_min, test.want_max)
+		}
+	}
+}
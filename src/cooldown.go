@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"ratelimit"
+)
+
+type CooldownConfig struct {
+	User     ratelimit.Limit            // Commands per user, on any channel.
+	Channel  ratelimit.Limit            // Commands per channel, or per user in queries.
+	Remote   ratelimit.Limit            // Shared by every command that queries another site.
+	Commands map[string]CommandCooldown // Extra limits per command, keyed by name, e.g. "s".
+	Warn     int                        // Seconds between "slow down" replies to the same user.
+}
+
+type CommandCooldown struct {
+	User    ratelimit.Limit
+	Channel ratelimit.Limit
+	Global  ratelimit.Limit // All users and channels together.
+}
+
+var cooldowns = ratelimit.New()
+
+// Limits with defaults filled in. A negative Count switches a limit off.
+func (cfg *Config) Cooldowns() CooldownConfig {
+	cooldown := cfg.Cooldown
+	if cooldown.User == (ratelimit.Limit{}) {
+		cooldown.User = ratelimit.Limit{Count: 5, Seconds: 30}
+	}
+	if cooldown.Remote == (ratelimit.Limit{}) {
+		cooldown.Remote = ratelimit.Limit{Count: 10, Seconds: 60}
+	}
+	if cooldown.Warn == 0 {
+		cooldown.Warn = 30
+	}
+	return cooldown
+}
+
+// Count a use of cmd against every limit that applies to it. Returns false if one of them
+// is used up, in which case the user is told to slow down every once in a while.
+func check_cooldown(ctx *CommandContext, cmd Command) bool {
+	if ctx.Role >= RoleTrusted {
+		return true
+	}
+	cooldown := config.Cooldowns()
+	net := ctx.Zax.Name + "/"
+	user := net + ctx.SenderHost
+	channel := net + ctx.ReplyTo
+	rules := []ratelimit.Rule{}
+	add := func(key string, limit ratelimit.Limit) {
+		rules = append(rules, ratelimit.Rule{Key: key, Limit: limit})
+	}
+	add("user:"+user, cooldown.User)
+	add("channel:"+channel, cooldown.Channel)
+	if limits, ok := cooldown.Commands[cmd.Name()]; ok {
+		add(cmd.Name()+":user:"+user, limits.User)
+		add(cmd.Name()+":channel:"+channel, limits.Channel)
+		add(cmd.Name(), limits.Global)
+	}
+	if remote, ok := cmd.(RemoteCommand); ok && remote.QueriesRemote() {
+		add("remote", cooldown.Remote)
+	}
+	allowed, wait := cooldowns.Allow(rules...)
+	if allowed {
+		return true
+	}
+	log.Debugf("%s (%s) is on cooldown for %s, %s left.", ctx.Sender, ctx.SenderHost, cmd.Name(), wait)
+	warn := ratelimit.Limit{Count: 1, Seconds: cooldown.Warn}
+	if ok, _ := cooldowns.Allow(ratelimit.Rule{Key: "warn:" + user, Limit: warn}); ok {
+		ctx.Reply(fmt.Sprintf("%s: Slow down, try again in %ds.", ctx.Sender, int(math.Ceil(wait.Seconds()))))
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package flood
+
+import (
+	"github.com/op/go-logging"
+	"sync"
+	"time"
+)
+
+var log = logging.MustGetLogger("flood")
+
+type Priority int
+
+const (
+	High   Priority = iota // Admin replies.
+	Normal                 // Command replies.
+	Low                    // Relayed traffic, dropped or merged first when the queue backs up.
+	priorities
+)
+
+// Relayed lines are merged into one while the result stays below this many bytes.
+const default_merge_limit = 400
+
+type Message struct {
+	Target string
+	Text   string
+}
+
+// Outbound message queue with a token bucket rate limit. Messages are sent in priority
+// order, and within a priority the targets take turns so one busy channel can't starve the rest.
+type Queue struct {
+	Rate       float64 // Messages per second.
+	Burst      int     // Messages that can be sent back to back after being idle.
+	MaxPending int     // Per target and priority, older low priority messages are merged or dropped beyond this.
+	MergeLimit int     // Longest line merging may produce.
+
+	send    func(target, text string)
+	ready   func() bool
+	lock    sync.Mutex
+	pending [priorities]map[string][]string
+	order   [priorities][]string // Targets with pending messages, in round robin order.
+	tokens  float64
+	last    time.Time
+	dropped int
+	wake    chan bool
+	stop    chan bool
+}
+
+// ready reports whether messages can be sent right now, e.g. if we're connected.
+func NewQueue(rate float64, burst, max_pending int, send func(target, text string), ready func() bool) *Queue {
+	queue := &Queue{
+		Rate:       rate,
+		Burst:      burst,
+		MaxPending: max_pending,
+		MergeLimit: default_merge_limit,
+		send:       send,
+		ready:      ready,
+		tokens:     float64(burst),
+		last:       time.Now(),
+		wake:       make(chan bool, 1),
+		stop:       make(chan bool),
+	}
+	for i := range queue.pending {
+		queue.pending[i] = make(map[string][]string)
+	}
+	return queue
+}
+
+func (queue *Queue) Push(target, text string, priority Priority) {
+	queue.lock.Lock()
+	msgs, waiting := queue.pending[priority][target]
+	if !waiting || len(msgs) == 0 {
+		queue.order[priority] = append(queue.order[priority], target)
+	}
+	msgs = append(msgs, text)
+	if priority == Low && queue.MaxPending > 0 {
+		msgs = queue.shrink(target, msgs)
+	}
+	queue.pending[priority][target] = msgs
+	queue.lock.Unlock()
+
+	select {
+	case queue.wake <- true:
+	default:
+	}
+}
+
+// Merge neighbouring messages where they fit on one line, then drop the oldest.
+func (queue *Queue) shrink(target string, msgs []string) []string {
+	for i := 0; len(msgs) > queue.MaxPending && i < len(msgs)-1; {
+		if len(msgs[i])+len(msgs[i+1])+3 <= queue.MergeLimit {
+			msgs[i] = msgs[i] + " | " + msgs[i+1]
+			msgs = append(msgs[:i+1], msgs[i+2:]...)
+		} else {
+			i++
+		}
+	}
+	if len(msgs) > queue.MaxPending {
+		drop := len(msgs) - queue.MaxPending
+		queue.dropped += drop
+		log.Warningf("Queue for %s is full, dropped %d messages (%d in total).", target, drop, queue.dropped)
+		msgs = msgs[drop:]
+	}
+	return msgs
+}
+
+// Next message to send, highest priority first and targets taking turns.
+func (queue *Queue) pop() (Message, bool) {
+	for priority := range queue.order {
+		order := queue.order[priority]
+		if len(order) == 0 {
+			continue
+		}
+		target := order[0]
+		msgs := queue.pending[priority][target]
+		text := msgs[0]
+		msgs = msgs[1:]
+		order = order[1:]
+		if len(msgs) > 0 {
+			order = append(order, target)
+			queue.pending[priority][target] = msgs
+		} else {
+			delete(queue.pending[priority], target)
+		}
+		queue.order[priority] = order
+		return Message{target, text}, true
+	}
+	return Message{}, false
+}
+
+// Change the limits while the queue runs, e.g. after a reload. Tokens saved up beyond
+// the new burst are dropped.
+func (queue *Queue) SetLimits(rate float64, burst, max_pending int) {
+	queue.lock.Lock()
+	queue.Rate, queue.Burst, queue.MaxPending = rate, burst, max_pending
+	if queue.tokens > float64(burst) {
+		queue.tokens = float64(burst)
+	}
+	queue.lock.Unlock()
+	// Whatever is waiting may go sooner now.
+	select {
+	case queue.wake <- true:
+	default:
+	}
+}
+
+func (queue *Queue) Len() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	n := 0
+	for _, pending := range queue.pending {
+		for _, msgs := range pending {
+			n += len(msgs)
+		}
+	}
+	return n
+}
+
+// Drop everything that hasn't been sent yet.
+func (queue *Queue) Clear() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i := range queue.pending {
+		queue.pending[i] = make(map[string][]string)
+		queue.order[i] = nil
+	}
+}
+
+// Time until the next token is available, taking it if there is one.
+func (queue *Queue) take() time.Duration {
+	now := time.Now()
+	queue.tokens += now.Sub(queue.last).Seconds() * queue.Rate
+	queue.last = now
+	if queue.tokens > float64(queue.Burst) {
+		queue.tokens = float64(queue.Burst)
+	}
+	if queue.tokens >= 1 {
+		queue.tokens--
+		return 0
+	}
+	return time.Duration((1 - queue.tokens) / queue.Rate * float64(time.Second))
+}
+
+func (queue *Queue) Run() {
+	for {
+		queue.lock.Lock()
+		wait := time.Duration(0)
+		msg, ok := Message{}, false
+		if queue.ready() {
+			wait = queue.take()
+			if wait == 0 {
+				msg, ok = queue.pop()
+				if !ok {
+					// Nothing to send, give the token back.
+					queue.tokens++
+				}
+			}
+		} else {
+			wait = time.Second
+		}
+		queue.lock.Unlock()
+
+		if ok {
+			queue.send(msg.Target, msg.Text)
+			continue
+		}
+		if wait == 0 {
+			// Idle until something is pushed.
+			select {
+			case <-queue.wake:
+			case <-queue.stop:
+				return
+			}
+			continue
+		}
+		select {
+		case <-time.After(wait):
+		case <-queue.wake:
+			// A push or new limits, work out the wait again.
+		case <-queue.stop:
+			return
+		}
+	}
+}
+
+func (queue *Queue) Stop() {
+	close(queue.stop)
+}
@@ -0,0 +1,195 @@
+package flood
+
+import (
+	"github.com/op/go-logging"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	logging.SetLevel(logging.ERROR, "")
+}
+
+func always() bool { return true }
+
+func TestTake(t *testing.T) {
+	queue := NewQueue(2, 3, 10, nil, always)
+	for i := 0; i < 3; i++ {
+		if wait := queue.take(); wait != 0 {
+			t.Fatalf("message %d of the burst has to wait %s", i+1, wait)
+		}
+	}
+	wait := queue.take()
+	if wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("after the burst: wait %s, want up to 500ms at 2 per second", wait)
+	}
+
+	// Tokens come back with time, but never more than the burst.
+	queue.tokens, queue.last = 0, time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		if wait := queue.take(); wait != 0 {
+			t.Fatalf("message %d after being idle has to wait %s", i+1, wait)
+		}
+	}
+	if wait := queue.take(); wait == 0 {
+		t.Error("being idle gave more tokens than the burst")
+	}
+}
+
+func drain(queue *Queue) []string {
+	sent := []string{}
+	for {
+		msg, ok := queue.pop()
+		if !ok {
+			return sent
+		}
+		sent = append(sent, msg.Target+":"+msg.Text)
+	}
+}
+
+func TestPopOrder(t *testing.T) {
+	queue := NewQueue(1, 1, 10, nil, always)
+	queue.Push("#a", "a1", Normal)
+	queue.Push("#a", "a2", Normal)
+	queue.Push("#a", "a3", Normal)
+	queue.Push("#b", "b1", Normal)
+	queue.Push("#report", "relay", Low)
+	queue.Push("#admin", "admin", High)
+	want := "#admin:admin #a:a1 #b:b1 #a:a2 #a:a3 #report:relay"
+	if got := strings.Join(drain(queue), " "); got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("Len = %d after sending everything", queue.Len())
+	}
+}
+
+func TestShrink(t *testing.T) {
+	tests := []struct {
+		name       string
+		msgs       []string
+		max, limit int
+		want       string
+		dropped    int
+	}{
+		{"fits", []string{"a", "b"}, 3, 400, "a,b", 0},
+		{"merged", []string{"a", "b", "c", "d"}, 2, 400, "a | b | c,d", 0},
+		{"merged up to the limit", []string{"aaaa", "bbbb", "cccc"}, 2, 11, "aaaa | bbbb,cccc", 0},
+		{"oldest dropped", []string{"aaaa", "bbbb", "cccc"}, 1, 4, "cccc", 2},
+	}
+	for _, test := range tests {
+		queue := NewQueue(1, 1, test.max, nil, always)
+		queue.MergeLimit = test.limit
+		for _, msg := range test.msgs {
+			queue.Push("#report", msg, Low)
+		}
+		if got := strings.Join(queue.pending[Low]["#report"], ","); got != test.want {
+			t.Errorf("%s: queued %q, want %q", test.name, got, test.want)
+		}
+		if queue.dropped != test.dropped {
+			t.Errorf("%s: dropped %d, want %d", test.name, queue.dropped, test.dropped)
+		}
+	}
+
+	// Only relayed messages are shrunk.
+	queue := NewQueue(1, 1, 1, nil, always)
+	queue.Push("#chan", "one", Normal)
+	queue.Push("#chan", "two", Normal)
+	if queue.Len() != 2 {
+		t.Errorf("normal messages were merged or dropped, %d left", queue.Len())
+	}
+}
+
+func TestRun(t *testing.T) {
+	var lock sync.Mutex
+	sent := []time.Time{}
+	done := make(chan bool)
+	queue := NewQueue(20, 2, 10, func(target, text string) {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, time.Now())
+		if len(sent) == 4 {
+			close(done)
+		}
+	}, always)
+	go queue.Run()
+	defer queue.Stop()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		queue.Push("#chan", "hello", Normal)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queue didn't send everything")
+	}
+	// Two go out at once, the other two at 20 per second.
+	lock.Lock()
+	defer lock.Unlock()
+	if d := sent[1].Sub(start); d > 30*time.Millisecond {
+		t.Errorf("the burst took %s", d)
+	}
+	if d := sent[3].Sub(start); d < 80*time.Millisecond {
+		t.Errorf("4 messages went out in %s, the rate allows 2 right away and 1 per 50ms", d)
+	}
+}
+
+func TestRunWaitsUntilReady(t *testing.T) {
+	var lock sync.Mutex
+	ready := false
+	sent := make(chan string, 1)
+	queue := NewQueue(10, 1, 10, func(target, text string) { sent <- text }, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return ready
+	})
+	go queue.Run()
+	defer queue.Stop()
+
+	queue.Push("#chan", "hello", Normal)
+	select {
+	case <-sent:
+		t.Fatal("sent while not connected")
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Lock()
+	ready = true
+	lock.Unlock()
+	select {
+	case <-sent:
+	case <-time.After(3 * time.Second):
+		t.Fatal("not sent once connected")
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	sent := make(chan string, 2)
+	queue := NewQueue(0.1, 1, 10, func(target, text string) { sent <- text }, always)
+	go queue.Run()
+	defer queue.Stop()
+
+	queue.Push("#chan", "one", Normal)
+	queue.Push("#chan", "two", Normal)
+	<-sent
+	select {
+	case <-sent:
+		t.Fatal("the second message didn't wait for the rate")
+	case <-time.After(100 * time.Millisecond):
+	}
+	queue.SetLimits(100, 1, 10)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("the faster rate didn't apply to the waiting message")
+	}
+
+	queue.SetLimits(1, 3, 2)
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.tokens > 3 || queue.MaxPending != 2 {
+		t.Errorf("tokens %f, MaxPending %d after SetLimits", queue.tokens, queue.MaxPending)
+	}
+}
@@ -0,0 +1,73 @@
+// Converts a history.log from the old comma separated format to JSON records, one per line.
+// Lines that are already records are copied as they are. Lines that can't be parsed are
+// listed on stderr and left out, and the exit status is 1 if there were any.
+//
+//	histmigrate -network freenode history.log history.new
+//
+// Stop the bot first, check the output, then move it over history.log.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"history"
+	"os"
+)
+
+func main() {
+	network := flag.String("network", "", "Network for lines from before networks were recorded, the Name of the first network in the config")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -network <name> <history.log> <output>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 || *network == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	in, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	defer in.Close()
+	// Never overwrite anything, least of all the history itself.
+	out, err := os.OpenFile(flag.Arg(1), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	writer := bufio.NewWriter(out)
+
+	converted, bad := 0, 0
+	err = history.Scan(in, *network, func(record history.Record) error {
+		data, err := history.Encode(record)
+		if err != nil {
+			return err
+		}
+		writer.Write(data)
+		converted++
+		return nil
+	}, func(n int, line string, err error) {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s: %s\n", flag.Arg(0), n, err.Error(), line)
+		bad++
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s: %s\n", flag.Arg(0), err.Error())
+		os.Exit(2)
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s: %s\n", flag.Arg(1), err.Error())
+		os.Exit(2)
+	}
+	if err := out.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s: %s\n", flag.Arg(1), err.Error())
+		os.Exit(2)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d records, %d lines couldn't be parsed.\n", converted, bad)
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
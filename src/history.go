@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	records "history"
+	"os"
+	"search"
+	"strings"
+	"sync"
+	"time"
+)
+
+const default_history_database = "history.db"
+const default_index_limit = 200000
+
+type HistoryConfig struct {
+	Store      string // "file" keeps everything in memory and appends to -history, "sqlite" uses Database (build with -tags sqlite_fts5). Defaults to file.
+	Database   string // Defaults to history.db. The first start imports -history into it.
+	IndexLimit int    // How many of the newest messages "msg find" searches with the file store. Defaults to 200000.
+}
+
+func (cfg *Config) index_limit() int {
+	if cfg.History.IndexLimit <= 0 {
+		return default_index_limit
+	}
+	return cfg.History.IndexLimit
+}
+
+func (cfg *Config) history_database() string {
+	if cfg.History.Database == "" {
+		return default_history_database
+	}
+	return cfg.History.Database
+}
+
+// Where the history is kept, see FileStore and SQLStore in the history package.
+// Queries return records newest first.
+type HistoryStore interface {
+	Add(record records.Record) error
+	Latest(filter records.Filter) (records.Record, bool, error)
+	Search(filter records.Filter, limit int) ([]records.Record, error)
+	Random(filter records.Filter) (records.Record, bool, error)
+	Count(filter records.Filter) (int, error)
+	Close() error
+}
+
+// Messages, urls and events of every network. Nicks on different networks are
+// different people, so queries are usually limited to one network.
+type IrcHistory struct {
+	store HistoryStore
+}
+
+var history IrcHistory
+
+// Full text index of the newest messages for "msg find" with the file store.
+// The SQL store has its own in the database.
+var message_index = search.New(0)
+
+// Keeps messages from being logged while the index is rebuilt, so none are missed.
+var index_lock sync.Mutex
+
+func open_history(path string) (HistoryStore, error) {
+	bad := 0
+	skip := func(n int, line string, err error) {
+		log.Warningf("Skipping line %d of %s: %s", n, path, err.Error())
+		bad++
+	}
+	defer func() {
+		if bad > 0 {
+			log.Warningf("%d lines of %s couldn't be loaded, see the warnings above.", bad, path)
+		}
+	}()
+	if config.History.Store != "sqlite" {
+		return records.OpenFileStore(path, default_network(), skip)
+	}
+
+	store, err := records.OpenSQLStore(config.history_database())
+	if err != nil {
+		return nil, err
+	}
+	count, err := store.Count(records.Filter{})
+	if err != nil || count > 0 {
+		return store, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		store.Close()
+		return nil, err
+	}
+	defer file.Close()
+	log.Noticef("Importing %s into %s...", path, config.history_database())
+	added, err := store.Import(file, default_network(), skip)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	log.Noticef("Imported %d records.", added)
+	return store, nil
+}
+
+// Returns the record as it was stored, nil if it couldn't be.
+func (history IrcHistory) add(record records.Record) *records.Record {
+	record.Time = time.Now().Unix()
+	index_lock.Lock()
+	defer index_lock.Unlock()
+	if err := history.store.Add(record); err != nil {
+		log.Errorf("Unable to add %s by %s to the history: %s", record.Kind, record.User, err.Error())
+		return nil
+	}
+	if _, ok := history.store.(*records.SQLStore); !ok && record.Kind == records.KindMessage {
+		message_index.Add(record)
+	}
+	return &record
+}
+
+// The file store's messages are indexed in memory on every start, the SQL store
+// keeps its index in the database.
+func load_index() error {
+	if _, ok := history.store.(*records.SQLStore); ok {
+		return nil
+	}
+	_, err := rebuild_index()
+	return err
+}
+
+// Builds the message index from scratch, from whatever is in the store.
+// Returns the number of messages indexed.
+func rebuild_index() (int, error) {
+	start := time.Now()
+	index_lock.Lock()
+	defer index_lock.Unlock()
+	count := 0
+	if store, ok := history.store.(*records.SQLStore); ok {
+		var err error
+		if count, err = store.Reindex(); err != nil {
+			return 0, err
+		}
+	} else {
+		limit := config.index_limit()
+		msgs, err := history.store.Search(records.Filter{Kind: records.KindMessage}, limit)
+		if err != nil {
+			return 0, err
+		}
+		// Oldest first.
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+		message_index.Rebuild(msgs, limit)
+		count = len(msgs)
+	}
+	log.Noticef("Indexed %d messages in %f seconds.", count, time.Since(start).Seconds())
+	return count, nil
+}
+
+// Full text search over messages, see the search package for the syntax.
+func search_messages(query *search.Query, filter records.Filter, order search.Order) ([]records.Record, error) {
+	if store, ok := history.store.(*records.SQLStore); ok {
+		match, err := query.FTS()
+		if err != nil {
+			return nil, err
+		}
+		return store.SearchText(match, filter, order == search.Relevance, 0)
+	}
+	found, err := message_index.Search(query, filter, order, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]records.Record, len(found))
+	for i, result := range found {
+		msgs[i] = result.Record
+	}
+	return msgs, nil
+}
+
+func (history IrcHistory) AddEvent(network, user, event, data, channel string) {
+	log.Debugf("Adding event '%s' for user '%s' on %s, channel is %s, additional data: %s", event, user, network, channel, data)
+	history.add(records.Record{Kind: records.KindEvent, Network: network, User: user, Channel: channel, Event: event, Data: data})
+}
+
+func (history IrcHistory) AddUrl(network, user, channel, url string) {
+	log.Debugf("Adding url '%s' for user '%s' in channel '%s' on %s", url, user, channel, network)
+	history.add(records.Record{Kind: records.KindUrl, Network: network, User: user, Channel: channel, Text: url})
+}
+
+func (history IrcHistory) AddMessage(network, user, channel, msg string) *records.Record {
+	log.Debugf("Adding message '%s' for user '%s' in channel '%s' on %s", msg, user, channel, network)
+	return history.add(records.Record{Kind: records.KindMessage, Network: network, User: user, Channel: channel, Text: msg})
+}
+
+// Logs errors, commands just get nothing back.
+func (history IrcHistory) Latest(filter records.Filter) (records.Record, bool) {
+	record, found, err := history.store.Latest(filter)
+	if err != nil {
+		log.Errorf("History query failed: %s", err.Error())
+	}
+	return record, found && err == nil
+}
+
+// One line for a record, the user gets the network if the search covered all of them.
+func format_record(record records.Record, with_network bool) string {
+	t := record.Timestamp()
+	stamp := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+	user := record.User
+	if with_network {
+		user += "@" + record.Network
+	}
+	switch record.Kind {
+	case records.KindUrl:
+		return stamp + " " + record.Text
+	case records.KindEvent:
+		switch record.Event {
+		case "join":
+			return fmt.Sprintf("%s %s joined %s", stamp, user, record.Channel)
+		case "quit":
+			return fmt.Sprintf("%s %s quit (%s)", stamp, user, record.Data)
+		}
+		return strings.TrimSpace(fmt.Sprintf("%s %s %s %s %s", stamp, user, record.Event, record.Channel, record.Data))
+	}
+	return fmt.Sprintf("%s %s: %s", stamp, user, record.Text)
+}
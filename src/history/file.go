@@ -0,0 +1,121 @@
+package history
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+// The whole history in memory, loaded from and appended to a file of records.
+// Simple, but startup takes longer and memory grows with the file.
+type FileStore struct {
+	lock    sync.RWMutex
+	file    *os.File
+	writer  *bufio.Writer
+	records []Record // Oldest first.
+}
+
+// Opens path, creating it if needed, and loads it. Lines from before networks were
+// recorded get network, lines that can't be parsed are passed to bad and left out.
+func OpenFileStore(path, network string, bad func(n int, line string, err error)) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store := &FileStore{file: file, writer: bufio.NewWriter(file), records: []Record{}}
+	err = Scan(file, network, func(record Record) error {
+		store.records = append(store.records, record)
+		return nil
+	}, bad)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *FileStore) Add(record Record) error {
+	record.V = Version
+	data, err := Encode(record)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, err := store.writer.Write(data); err != nil {
+		return err
+	}
+	store.records = append(store.records, record)
+	return store.writer.Flush()
+}
+
+// Calls fn with the matching records, newest first unless Filter.Oldest, until it returns false.
+func (store *FileStore) each(filter Filter, fn func(record *Record) bool) error {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	n := len(store.records)
+	for i := 0; i < n; i++ {
+		if filter.Expired(i) {
+			return ErrDeadline
+		}
+		record := &store.records[n-1-i]
+		if filter.Oldest {
+			record = &store.records[i]
+		}
+		if filter.Matches(record) && !fn(record) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (store *FileStore) Latest(filter Filter) (Record, bool, error) {
+	latest := Record{}
+	found := false
+	err := store.each(filter, func(record *Record) bool {
+		latest, found = *record, true
+		return false
+	})
+	return latest, found, err
+}
+
+func (store *FileStore) Search(filter Filter, limit int) ([]Record, error) {
+	result := []Record{}
+	err := store.each(filter, func(record *Record) bool {
+		result = append(result, *record)
+		return limit <= 0 || len(result) < limit
+	})
+	return result, err
+}
+
+func (store *FileStore) Random(filter Filter) (Record, bool, error) {
+	matches := []*Record{}
+	err := store.each(filter, func(record *Record) bool {
+		matches = append(matches, record)
+		return true
+	})
+	if err != nil || len(matches) == 0 {
+		return Record{}, false, err
+	}
+	return *matches[rand.Intn(len(matches))], true, nil
+}
+
+func (store *FileStore) Count(filter Filter) (int, error) {
+	count := 0
+	err := store.each(filter, func(record *Record) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+func (store *FileStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if err := store.writer.Flush(); err != nil {
+		store.file.Close()
+		return err
+	}
+	return store.file.Close()
+}
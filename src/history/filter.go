@@ -0,0 +1,106 @@
+package history
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Returned by queries that ran past Filter.Deadline.
+var ErrDeadline = errors.New("the search took too long")
+
+// Records between deadline checks, time.Now isn't free.
+const deadline_interval = 1024
+
+// Which records a query is about. Empty fields match everything.
+type Filter struct {
+	Kind     string // KindMessage, KindEvent or KindUrl.
+	Network  string
+	User     string // Nicks and channels are compared without case.
+	Channel  string
+	Since    int64                  // Unix time, inclusive.
+	Before   int64                  // Unix time, exclusive.
+	Match    func(text string) bool // Called with Record.Content.
+	Oldest   bool                   // Search oldest first instead of newest first.
+	Deadline time.Time              // Give up on scanning with ErrDeadline after this, if set.
+	Skip     *Record                // Leave this one out, e.g. the line that asked for the search.
+}
+
+// Whether the query has to give up, checked every so many records.
+func (filter *Filter) Expired(n int) bool {
+	return n%deadline_interval == deadline_interval-1 && !filter.Deadline.IsZero() && time.Now().After(filter.Deadline)
+}
+
+func (filter *Filter) Matches(record *Record) bool {
+	return filter.matches_fields(record) && (filter.Match == nil || filter.Match(record.Content()))
+}
+
+// Everything but Match, which is the part the SQL store can't do in SQL.
+func (filter *Filter) matches_fields(record *Record) bool {
+	switch {
+	case filter.Kind != "" && record.Kind != filter.Kind:
+		return false
+	case filter.Network != "" && record.Network != filter.Network:
+		return false
+	case filter.User != "" && !strings.EqualFold(record.User, filter.User):
+		return false
+	case filter.Channel != "" && !strings.EqualFold(record.Channel, filter.Channel):
+		return false
+	case filter.Since != 0 && record.Time < filter.Since:
+		return false
+	case filter.Before != 0 && record.Time >= filter.Before:
+		return false
+	case filter.Skip != nil && same_record(record, filter.Skip):
+		return false
+	}
+	return true
+}
+
+// Records have no id that's the same in every store, so they're compared by what's in them.
+func same_record(a, b *Record) bool {
+	return a.Kind == b.Kind && a.Time == b.Time && a.Network == b.Network && a.User == b.User &&
+		a.Channel == b.Channel && a.Text == b.Text && a.Event == b.Event && a.Data == b.Data
+}
+
+func (filter *Filter) where() (string, []interface{}) {
+	conds, args := filter.conditions()
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Everything but Match as SQL conditions on the history table, with the table name
+// so they also work in joins.
+func (filter *Filter) conditions() ([]string, []interface{}) {
+	conds := []string{}
+	args := []interface{}{}
+	add := func(cond string, arg interface{}) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if filter.Kind != "" {
+		add("history.kind = ?", filter.Kind)
+	}
+	if filter.Network != "" {
+		add("history.network = ?", filter.Network)
+	}
+	if filter.User != "" {
+		add("history.user = ?", filter.User)
+	}
+	if filter.Channel != "" {
+		add("history.channel = ?", filter.Channel)
+	}
+	if filter.Since != 0 {
+		add("history.time >= ?", filter.Since)
+	}
+	if filter.Before != 0 {
+		add("history.time < ?", filter.Before)
+	}
+	if skip := filter.Skip; skip != nil {
+		conds = append(conds, "NOT (history.kind = ? AND history.time = ? AND history.network = ? AND history.user = ? AND history.channel = ?"+
+			" AND history.text = ? AND history.event = ? AND history.data = ?)")
+		args = append(args, skip.Kind, skip.Time, skip.Network, skip.User, skip.Channel, skip.Text, skip.Event, skip.Data)
+	}
+	return conds, args
+}
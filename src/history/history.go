@@ -0,0 +1,156 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the record format, written to every line.
+const Version = 1
+
+const (
+	KindMessage = "msg"
+	KindEvent   = "event"
+	KindUrl     = "url"
+)
+
+// One line of the history file, stored as JSON.
+type Record struct {
+	V       int    `json:"v"`
+	Kind    string `json:"kind"`
+	Time    int64  `json:"time"` // Unix time.
+	Network string `json:"net"`
+	User    string `json:"user"`
+	Channel string `json:"chan,omitempty"`
+	Text    string `json:"text,omitempty"`  // Message text or URL.
+	Event   string `json:"event,omitempty"` // join, quit, ...
+	Data    string `json:"data,omitempty"`  // e.g. the quit message.
+}
+
+func (record Record) Timestamp() time.Time {
+	return time.Unix(record.Time, 0)
+}
+
+// What patterns are matched against: the message text, the url or the event data.
+func (record Record) Content() string {
+	if record.Kind == KindEvent {
+		return record.Data
+	}
+	return record.Text
+}
+
+func (record *Record) validate() error {
+	switch record.Kind {
+	case KindMessage, KindEvent, KindUrl:
+	default:
+		return fmt.Errorf("unknown record kind '%s'", record.Kind)
+	}
+	if record.User == "" {
+		return errors.New("record has no user")
+	}
+	return nil
+}
+
+func Encode(record Record) ([]byte, error) {
+	record.V = Version
+	if err := record.validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func Decode(line []byte) (Record, error) {
+	record := Record{}
+	if err := json.Unmarshal(line, &record); err != nil {
+		return record, err
+	}
+	if record.V < 1 || record.V > Version {
+		return record, fmt.Errorf("unsupported record version %d", record.V)
+	}
+	return record, record.validate()
+}
+
+// Lines from before records were JSON look like kind[:network],time,user,...
+func IsLegacy(line string) bool {
+	return !strings.HasPrefix(strings.TrimSpace(line), "{")
+}
+
+// Parse a line of the old comma separated format. Commas in message text weren't
+// escaped, so everything after the fixed fields is taken to be the text.
+// Lines without a network tag are from before networks existed and get network.
+//
+//	msg[:net],time,user,channel,text
+//	event[:net],time,user,channel,event,data
+//	url[:net],time,user,url
+func ParseLegacy(line, network string) (Record, error) {
+	parts := strings.Split(line, ",")
+	if len(parts) < 4 {
+		return Record{}, errors.New("too few fields")
+	}
+	kind := strings.SplitN(parts[0], ":", 2)
+	if len(kind) == 2 {
+		network = kind[1]
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid time '%s'", parts[1])
+	}
+	record := Record{V: Version, Kind: kind[0], Time: ts, Network: network, User: parts[2]}
+	switch record.Kind {
+	case KindMessage:
+		if len(parts) < 5 {
+			return Record{}, errors.New("message without text")
+		}
+		record.Channel = parts[3]
+		record.Text = strings.Join(parts[4:], ",")
+	case KindEvent:
+		if len(parts) < 5 {
+			return Record{}, errors.New("event without a name")
+		}
+		// Event names are plain words, the data (quit messages) may have commas.
+		record.Channel = parts[3]
+		record.Event = parts[4]
+		record.Data = strings.Join(parts[5:], ",")
+	case KindUrl:
+		record.Text = strings.Join(parts[3:], ",")
+	}
+	return record, record.validate()
+}
+
+// Reads a history file, calling add for every record. Lines in the old format are
+// converted, the ones without a network tag get network. Lines that can't be parsed,
+// or that add fails on, are passed to bad with their line number.
+func Scan(reader io.Reader, network string, add func(Record) error, bad func(n int, line string, err error)) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record Record
+		var err error
+		if IsLegacy(line) {
+			record, err = ParseLegacy(line, network)
+		} else {
+			record, err = Decode(scanner.Bytes())
+		}
+		if err == nil {
+			err = add(record)
+		}
+		if err != nil {
+			bad(n, line, err)
+		}
+	}
+	return scanner.Err()
+}
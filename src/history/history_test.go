@@ -0,0 +1,93 @@
+package history
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLegacy(t *testing.T) {
+	tests := []struct {
+		line string
+		want Record
+		ok   bool
+	}{
+		{"msg,100,bob,#chan,hi, there", Record{V: Version, Kind: KindMessage, Time: 100, Network: "def", User: "bob", Channel: "#chan", Text: "hi, there"}, true},
+		{"msg:other,100,bob,#chan,hi", Record{V: Version, Kind: KindMessage, Time: 100, Network: "other", User: "bob", Channel: "#chan", Text: "hi"}, true},
+		{"event,100,bob,#chan,quit,bye, all", Record{V: Version, Kind: KindEvent, Time: 100, Network: "def", User: "bob", Channel: "#chan", Event: "quit", Data: "bye, all"}, true},
+		{"event,100,bob,#chan,join", Record{V: Version, Kind: KindEvent, Time: 100, Network: "def", User: "bob", Channel: "#chan", Event: "join"}, true},
+		{"url,100,bob,http://example.com/a,b", Record{V: Version, Kind: KindUrl, Time: 100, Network: "def", User: "bob", Text: "http://example.com/a,b"}, true},
+		{"msg,100,bob", Record{}, false},
+		{"msg,100,bob,#chan", Record{}, false},
+		{"msg,soon,bob,#chan,hi", Record{}, false},
+		{"note,100,bob,#chan,hi", Record{}, false},
+		{"msg,100,,#chan,hi", Record{}, false},
+	}
+	for _, test := range tests {
+		got, err := ParseLegacy(test.line, "def")
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v, want ok %t", test.line, err, test.ok)
+			continue
+		}
+		if test.ok && got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	records := []Record{
+		{Kind: KindMessage, Time: 1, Network: "n", User: "bob", Channel: "#c", Text: "héllo \"quoted\""},
+		{Kind: KindEvent, Time: 2, Network: "n", User: "bob", Channel: "#c", Event: "quit", Data: "bye"},
+		{Kind: KindUrl, Time: 3, Network: "n", User: "bob", Text: "http://example.com"},
+	}
+	for _, record := range records {
+		data, err := Encode(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decode(data)
+		record.V = Version
+		if err != nil || got != record {
+			t.Errorf("got %+v, %v, want %+v", got, err, record)
+		}
+	}
+	if _, err := Encode(Record{Kind: KindMessage}); err == nil {
+		t.Error("encoded a record without a user")
+	}
+	for _, line := range []string{`{"v":0,"kind":"msg","user":"a"}`, `{"v":99,"kind":"msg","user":"a"}`, `{"v":1,"kind":"x","user":"a"}`, `{`} {
+		if _, err := Decode([]byte(line)); err == nil {
+			t.Errorf("decoded %s", line)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	input := strings.Join([]string{
+		`{"v":1,"kind":"msg","time":1,"net":"n","user":"a","text":"json"}`,
+		"msg,2,b,#c,legacy",
+		"",
+		"garbage",
+		`{"v":1,"kind":"msg","time":3,"net":"n","user":"skip","text":"refused"}`,
+	}, "\n")
+	added := []string{}
+	bad := []int{}
+	err := Scan(strings.NewReader(input), "n", func(record Record) error {
+		if record.User == "skip" {
+			return ErrDeadline
+		}
+		added = append(added, record.Text)
+		return nil
+	}, func(n int, line string, err error) {
+		bad = append(bad, n)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(added, []string{"json", "legacy"}) {
+		t.Errorf("added %q", added)
+	}
+	if !reflect.DeepEqual(bad, []int{4, 5}) {
+		t.Errorf("bad lines %v, want 4 and 5", bad)
+	}
+}
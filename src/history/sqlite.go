@@ -0,0 +1,292 @@
+package history
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"io"
+	"math/rand"
+	"strings"
+)
+
+// What takes the schema from one version to the next, sql_migrations[i] makes version i+1.
+var sql_migrations = [][]string{{
+	`CREATE TABLE IF NOT EXISTS history (
+		id INTEGER PRIMARY KEY,
+		kind TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		network TEXT NOT NULL,
+		user TEXT NOT NULL COLLATE NOCASE,
+		channel TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+		text TEXT NOT NULL DEFAULT '',
+		event TEXT NOT NULL DEFAULT '',
+		data TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS history_user ON history (user, network, kind, time)`,
+	`CREATE INDEX IF NOT EXISTS history_channel ON history (channel, network, kind, time)`,
+	`CREATE INDEX IF NOT EXISTS history_time ON history (time)`,
+}, {
+	// Full text index of the messages. SQLite has to be built with FTS5, go build -tags sqlite_fts5.
+	`CREATE VIRTUAL TABLE history_fts USING fts5(text, content='history', content_rowid='id',
+		tokenize='unicode61 remove_diacritics 0')`,
+	`CREATE TRIGGER history_fts_add AFTER INSERT ON history WHEN NEW.kind = 'msg' BEGIN
+		INSERT INTO history_fts (rowid, text) VALUES (NEW.id, NEW.text);
+	END`,
+	sql_index_messages,
+}}
+
+var sql_schema_version = len(sql_migrations)
+
+const sql_index_messages = "INSERT INTO history_fts (rowid, text) SELECT id, text FROM history WHERE kind = 'msg'"
+
+const sql_columns = "kind, time, network, user, channel, text, event, data"
+
+// The same for queries that join history with history_fts, which has a text column too.
+var sql_history_columns = "history." + strings.Replace(sql_columns, ", ", ", history.", -1)
+
+// History in an SQLite database, only what a query needs is read.
+type SQLStore struct {
+	db *sql.DB
+}
+
+func OpenSQLStore(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// Networks write from their own goroutines, SQLite wants one writer at a time.
+	db.SetMaxOpenConns(1)
+	store := &SQLStore{db}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *SQLStore) migrate() error {
+	version := 0
+	if err := store.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < sql_schema_version; version++ {
+		if err := store.upgrade(version + 1); err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				err = errors.New("SQLite was built without FTS5, build zax with -tags sqlite_fts5")
+			}
+			return fmt.Errorf("unable to upgrade the database to version %d: %s", version+1, err.Error())
+		}
+	}
+	return nil
+}
+
+// Each version is done in one transaction, so a failed upgrade can simply be tried again.
+func (store *SQLStore) upgrade(version int) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range sql_migrations[version-1] {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type sql_execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insert(db sql_execer, record Record) error {
+	record.V = Version
+	if err := record.validate(); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO history ("+sql_columns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		record.Kind, record.Time, record.Network, record.User, record.Channel, record.Text, record.Event, record.Data)
+	return err
+}
+
+func (store *SQLStore) Add(record Record) error {
+	return insert(store.db, record)
+}
+
+// Loads a history file into the database in one transaction, see Scan.
+// Records that can't be inserted are passed to bad like unreadable lines.
+// Returns the number of records added.
+func (store *SQLStore) Import(reader io.Reader, network string, bad func(n int, line string, err error)) (int, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	err = Scan(reader, network, func(record Record) error {
+		if err := insert(tx, record); err != nil {
+			return err
+		}
+		added++
+		return nil
+	}, bad)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return added, tx.Commit()
+}
+
+// Calls fn with the matching records, newest first unless Filter.Oldest, until it returns false.
+// Filter.Match can't be done in SQL, so limit only applies without it.
+func (store *SQLStore) each(filter Filter, limit int, fn func(record *Record) bool) error {
+	where, args := filter.where()
+	query := "SELECT " + sql_columns + " FROM history" + where + " ORDER BY time DESC, id DESC"
+	if filter.Oldest {
+		query = "SELECT " + sql_columns + " FROM history" + where + " ORDER BY time, id"
+	}
+	if filter.Match == nil && limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	return store.scan(filter, query, args, fn)
+}
+
+// Runs a query for sql_columns and calls fn with the records that pass Filter.Match.
+func (store *SQLStore) scan(filter Filter, query string, args []interface{}, fn func(record *Record) bool) error {
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for n := 0; rows.Next(); n++ {
+		if filter.Expired(n) {
+			return ErrDeadline
+		}
+		record := Record{V: Version}
+		err := rows.Scan(&record.Kind, &record.Time, &record.Network, &record.User, &record.Channel,
+			&record.Text, &record.Event, &record.Data)
+		if err != nil {
+			return err
+		}
+		if filter.Match != nil && !filter.Match(record.Content()) {
+			continue
+		}
+		if !fn(&record) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// Messages matching an FTS5 query that also pass filter, newest first, or best
+// match first with relevance. Filter.Kind is ignored, only messages are indexed.
+func (store *SQLStore) SearchText(match string, filter Filter, relevance bool, limit int) ([]Record, error) {
+	filter.Kind = ""
+	conds, args := filter.conditions()
+	conds = append([]string{"history_fts MATCH ?"}, conds...)
+	args = append([]interface{}{match}, args...)
+	query := "SELECT " + sql_history_columns + " FROM history_fts JOIN history ON history.id = history_fts.rowid" +
+		" WHERE " + strings.Join(conds, " AND ")
+	if relevance {
+		query += " ORDER BY rank, history.time DESC, history.id DESC"
+	} else {
+		query += " ORDER BY history.time DESC, history.id DESC"
+	}
+	if filter.Match == nil && limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	result := []Record{}
+	err := store.scan(filter, query, args, func(record *Record) bool {
+		result = append(result, *record)
+		return limit <= 0 || len(result) < limit
+	})
+	return result, err
+}
+
+// Builds the full text index again from the messages, returns how many there are.
+func (store *SQLStore) Reindex() (int, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("INSERT INTO history_fts (history_fts) VALUES ('delete-all')"); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	result, err := tx.Exec(sql_index_messages)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return int(count), tx.Commit()
+}
+
+func (store *SQLStore) Latest(filter Filter) (Record, bool, error) {
+	latest := Record{}
+	found := false
+	err := store.each(filter, 1, func(record *Record) bool {
+		latest, found = *record, true
+		return false
+	})
+	return latest, found, err
+}
+
+func (store *SQLStore) Search(filter Filter, limit int) ([]Record, error) {
+	result := []Record{}
+	err := store.each(filter, limit, func(record *Record) bool {
+		result = append(result, *record)
+		return limit <= 0 || len(result) < limit
+	})
+	return result, err
+}
+
+func (store *SQLStore) Random(filter Filter) (Record, bool, error) {
+	if filter.Match != nil {
+		matches, err := store.Search(filter, 0)
+		if err != nil || len(matches) == 0 {
+			return Record{}, false, err
+		}
+		return matches[rand.Intn(len(matches))], true, nil
+	}
+	count, err := store.Count(filter)
+	if err != nil || count == 0 {
+		return Record{}, false, err
+	}
+	where, args := filter.where()
+	record := Record{V: Version}
+	err = store.db.QueryRow("SELECT "+sql_columns+" FROM history"+where+" LIMIT 1 OFFSET ?", append(args, rand.Intn(count))...).
+		Scan(&record.Kind, &record.Time, &record.Network, &record.User, &record.Channel, &record.Text, &record.Event, &record.Data)
+	if err != nil {
+		return Record{}, false, err
+	}
+	return record, true, nil
+}
+
+func (store *SQLStore) Count(filter Filter) (int, error) {
+	count := 0
+	if filter.Match != nil {
+		err := store.each(filter, 0, func(record *Record) bool {
+			count++
+			return true
+		})
+		return count, err
+	}
+	where, args := filter.where()
+	err := store.db.QueryRow("SELECT COUNT(*) FROM history"+where, args...).Scan(&count)
+	return count, err
+}
+
+func (store *SQLStore) Close() error {
+	return store.db.Close()
+}
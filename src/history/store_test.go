@@ -0,0 +1,247 @@
+package history
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type store_interface interface {
+	Add(record Record) error
+	Latest(filter Filter) (Record, bool, error)
+	Search(filter Filter, limit int) ([]Record, error)
+	Random(filter Filter) (Record, bool, error)
+	Count(filter Filter) (int, error)
+	Close() error
+}
+
+var stores = []struct {
+	name string
+	open func(t *testing.T, path string) store_interface
+}{
+	{"file", func(t *testing.T, path string) store_interface {
+		store, err := OpenFileStore(path, "n", func(n int, line string, err error) {
+			t.Errorf("line %d: %s", n, err.Error())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"sqlite", func(t *testing.T, path string) store_interface {
+		store, err := OpenSQLStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+}
+
+var test_records = []Record{
+	{Kind: KindMessage, Time: 10, Network: "n", User: "Alice", Channel: "#Chan", Text: "hello world"},
+	{Kind: KindEvent, Time: 20, Network: "n", User: "bob", Channel: "#chan", Event: "join"},
+	{Kind: KindMessage, Time: 30, Network: "n", User: "bob", Channel: "#chan", Text: "hello alice"},
+	{Kind: KindUrl, Time: 40, Network: "n", User: "alice", Text: "http://example.com"},
+	{Kind: KindMessage, Time: 50, Network: "m", User: "alice", Channel: "#other", Text: "elsewhere"},
+}
+
+func texts(records []Record) string {
+	parts := []string{}
+	for _, record := range records {
+		parts = append(parts, record.Content()+record.Event)
+	}
+	return strings.Join(parts, ",")
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	tests := []struct {
+		filter Filter
+		limit  int
+		want   string
+	}{
+		{Filter{}, 0, "elsewhere,http://example.com,hello alice,join,hello world"},
+		{Filter{}, 2, "elsewhere,http://example.com"},
+		{Filter{Oldest: true}, 2, "hello world,join"},
+		{Filter{Kind: KindMessage, Network: "n"}, 0, "hello alice,hello world"},
+		{Filter{User: "ALICE"}, 0, "elsewhere,http://example.com,hello world"},
+		{Filter{Channel: "#CHAN", Kind: KindMessage}, 0, "hello alice,hello world"},
+		{Filter{Since: 20, Before: 40}, 0, "hello alice,join"},
+		{Filter{Match: func(text string) bool { return strings.Contains(text, "hello") }}, 1, "hello alice"},
+		{Filter{User: "nobody"}, 0, ""},
+		{Filter{User: "bob", Skip: &test_records[2]}, 0, "join"},
+		{Filter{Kind: KindMessage, Skip: &Record{Kind: KindMessage, Time: 30, Network: "n", User: "bob", Channel: "#chan", Text: "hello"}}, 0, "elsewhere,hello alice,hello world"},
+	}
+	for _, s := range stores {
+		path := filepath.Join(t.TempDir(), "history")
+		store := s.open(t, path)
+		for _, record := range test_records {
+			if err := store.Add(record); err != nil {
+				t.Fatalf("%s: %s", s.name, err.Error())
+			}
+		}
+		if err := store.Add(Record{Kind: KindMessage, Network: "n"}); err == nil {
+			t.Errorf("%s: added a record without a user", s.name)
+		}
+		store.Close()
+
+		// Everything has to come back after reopening.
+		store = s.open(t, path)
+		for i, test := range tests {
+			got, err := store.Search(test.filter, test.limit)
+			if err != nil {
+				t.Fatalf("%s: %s", s.name, err.Error())
+			}
+			if texts(got) != test.want {
+				t.Errorf("%s, search %d: got %s, want %s", s.name, i+1, texts(got), test.want)
+			}
+			count, err := store.Count(test.filter)
+			if want := len(strings.Split(test.want, ",")); err != nil || (test.limit == 0 && test.want != "" && count != want) {
+				t.Errorf("%s, search %d: count %d, %v, want %d", s.name, i+1, count, err, want)
+			}
+		}
+		latest, found, err := store.Latest(Filter{User: "bob"})
+		want := test_records[2]
+		want.V = Version
+		if err != nil || !found || latest != want {
+			t.Errorf("%s: latest %+v, %t, %v, want %+v", s.name, latest, found, err, want)
+		}
+		for i := 0; i < 10; i++ {
+			record, found, err := store.Random(Filter{Kind: KindMessage, Network: "n"})
+			if err != nil || !found || !strings.HasPrefix(record.Text, "hello") {
+				t.Errorf("%s: random %+v, %t, %v", s.name, record, found, err)
+			}
+		}
+		if _, found, _ := store.Random(Filter{User: "nobody"}); found {
+			t.Errorf("%s: random found a record for nobody", s.name)
+		}
+		store.Close()
+	}
+}
+
+func TestImport(t *testing.T) {
+	store, err := OpenSQLStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	_, err = store.db.Exec(`CREATE TRIGGER refuse BEFORE INSERT ON history WHEN NEW.user = 'refused'
+		BEGIN SELECT RAISE(ABORT, 'refused'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Join([]string{
+		"msg,1,a,#c,one",
+		"not a record",
+		"msg,2,refused,#c,two",
+		`{"v":1,"kind":"msg","time":3,"net":"n","user":"b","chan":"#c","text":"three"}`,
+	}, "\n")
+	bad := []int{}
+	added, err := store.Import(strings.NewReader(input), "n", func(n int, line string, err error) {
+		bad = append(bad, n)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Errorf("added %d, want 2", added)
+	}
+	if !reflect.DeepEqual(bad, []int{2, 3}) {
+		t.Errorf("bad lines %v, want 2 and 3", bad)
+	}
+	if count, _ := store.Count(Filter{}); count != 2 {
+		t.Errorf("%d records in the database, want 2", count)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	store, err := OpenSQLStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	version := 0
+	if err := store.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != sql_schema_version {
+		t.Errorf("user_version %d, %v, want %d", version, err, sql_schema_version)
+	}
+}
+
+func TestSearchText(t *testing.T) {
+	store, err := OpenSQLStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, record := range test_records {
+		store.Add(record)
+	}
+	store.Add(Record{Kind: KindMessage, Time: 60, Network: "n", User: "carol", Channel: "#chan", Text: "hello hello hello"})
+	tests := []struct {
+		match     string
+		filter    Filter
+		relevance bool
+		limit     int
+		want      string
+	}{
+		{`"hello"`, Filter{}, false, 0, "hello hello hello,hello alice,hello world"},
+		{`"hello"`, Filter{}, true, 1, "hello hello hello"},
+		{`"hello"`, Filter{User: "BOB"}, false, 0, "hello alice"},
+		{`"hello" NOT "world"`, Filter{Before: 60}, false, 0, "hello alice"},
+		{`"example"`, Filter{}, false, 0, ""},
+		{`"join"`, Filter{}, false, 0, ""},
+		{`("elsewhere" OR "world")`, Filter{Network: "n"}, false, 0, "hello world"},
+		{`"hello"`, Filter{Match: func(text string) bool { return strings.HasSuffix(text, "alice") }}, false, 1, "hello alice"},
+		{`"hello"`, Filter{Skip: &test_records[0]}, false, 0, "hello hello hello,hello alice"},
+	}
+	for i, test := range tests {
+		got, err := store.SearchText(test.match, test.filter, test.relevance, test.limit)
+		if err != nil {
+			t.Fatalf("search %d: %s", i+1, err.Error())
+		}
+		if texts(got) != test.want {
+			t.Errorf("search %d: got %s, want %s", i+1, texts(got), test.want)
+		}
+	}
+
+	// The index can be dropped and built again.
+	if _, err := store.db.Exec("INSERT INTO history_fts (history_fts) VALUES ('delete-all')"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.SearchText(`"hello"`, Filter{}, false, 0); len(got) != 0 {
+		t.Fatalf("found %s in an empty index", texts(got))
+	}
+	if count, err := store.Reindex(); err != nil || count != 4 {
+		t.Errorf("reindexed %d, %v, want the 4 messages", count, err)
+	}
+	if got, _ := store.SearchText(`"hello"`, Filter{}, false, 0); len(got) != 3 {
+		t.Errorf("found %s after reindexing", texts(got))
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := OpenSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Back to the first version, which had no full text index.
+	for _, stmt := range []string{"DROP TRIGGER history_fts_add", "DROP TABLE history_fts", "PRAGMA user_version = 1"} {
+		if _, err := store.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, record := range test_records {
+		store.Add(record)
+	}
+	store.Close()
+
+	store, err = OpenSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	got, err := store.SearchText(`"hello"`, Filter{}, false, 0)
+	if err != nil || texts(got) != "hello alice,hello world" {
+		t.Errorf("after the upgrade found %s, %v", texts(got), err)
+	}
+}
@@ -0,0 +1,275 @@
+package ignore
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logging.MustGetLogger("ignore")
+
+// What an entry can keep from happening.
+const (
+	Log      = "log"      // Message and URL history.
+	Relay    = "relay"    // Copying messages to the report channel.
+	Commands = "commands" // Running commands.
+	Urls     = "urls"     // Looking up links.
+)
+
+var Scopes = []string{Log, Relay, Commands, Urls}
+
+func IsScope(s string) bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type Entry struct {
+	Mask    string   // A nick, a nick!user@host pattern with * and ?, or a /regex/ on nick!user@host.
+	Scopes  []string `json:",omitempty"` // Everything if empty.
+	Expires int64    `json:",omitempty"` // Unix time, never if 0.
+	By      string   `json:",omitempty"` // Who added it.
+	Text    string   `json:",omitempty"` // Only lines containing this, or matching it if it's a /regex/. Any line if empty.
+
+	expr      *regexp.Regexp
+	text_expr *regexp.Regexp
+}
+
+// Turn a mask into an expression on nick!user@host.
+func Compile(mask string) (*regexp.Regexp, error) {
+	if len(mask) > 2 && strings.HasPrefix(mask, "/") && strings.HasSuffix(mask, "/") {
+		return regexp.Compile("(?i)" + mask[1:len(mask)-1])
+	}
+	if mask == "" {
+		return nil, fmt.Errorf("empty mask")
+	}
+	expr := regexp.QuoteMeta(mask)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	if !strings.ContainsAny(mask, "!@") {
+		// Just a nick.
+		expr += "!.*"
+	}
+	return regexp.Compile("(?i)^" + expr + "$")
+}
+
+// Turn an entry's Text into an expression, both ignore case.
+func CompileText(text string) (*regexp.Regexp, error) {
+	if len(text) > 2 && strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
+		return regexp.Compile("(?i)" + text[1:len(text)-1])
+	}
+	return regexp.Compile("(?i)" + regexp.QuoteMeta(text))
+}
+
+// Take text:<text> out of the arguments of an ignore command. The text is the rest of the
+// line so it can have spaces, unless it's in double quotes: text:"buy now" 1d.
+func SplitText(args []string) (string, []string, error) {
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "text:") {
+			continue
+		}
+		text := strings.TrimPrefix(strings.Join(args[i:], " "), "text:")
+		rest := append([]string{}, args[:i]...)
+		if strings.HasPrefix(text, `"`) {
+			// The closing quote is the first one that ends an argument.
+			end := strings.Index(text[1:]+" ", `" `)
+			if end < 0 {
+				return "", nil, fmt.Errorf("the text is missing its closing quote")
+			}
+			rest = append(rest, strings.Fields(text[1+end+1:])...)
+			text = text[1 : 1+end]
+		}
+		if strings.TrimSpace(text) == "" {
+			return "", nil, fmt.Errorf("no text given")
+		}
+		return text, rest, nil
+	}
+	return "", args, nil
+}
+
+// Compiles the mask and text of an entry that was decoded or built by hand.
+func (entry *Entry) compile() error {
+	expr, err := Compile(entry.Mask)
+	if err != nil {
+		return err
+	}
+	entry.expr = expr
+	entry.text_expr = nil
+	if entry.Text != "" {
+		if entry.text_expr, err = CompileText(entry.Text); err != nil {
+			return fmt.Errorf("invalid text: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (entry *Entry) Expired(now time.Time) bool {
+	return entry.Expires != 0 && now.Unix() >= entry.Expires
+}
+
+func (entry *Entry) Covers(scope string) bool {
+	if len(entry.Scopes) == 0 {
+		return true
+	}
+	for _, s := range entry.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (entry *Entry) String() string {
+	s := entry.Mask
+	if len(entry.Scopes) > 0 {
+		s += " [" + strings.Join(entry.Scopes, ",") + "]"
+	}
+	if entry.Text != "" {
+		s += " matching " + entry.Text
+	}
+	if entry.Expires != 0 {
+		s += " until " + time.Unix(entry.Expires, 0).Format("2006-01-02 15:04")
+	}
+	if entry.By != "" {
+		s += " by " + entry.By
+	}
+	return s
+}
+
+// Ignore entries, saved to a JSON file on every change.
+type List struct {
+	lock    sync.Mutex
+	path    string
+	entries []*Entry
+}
+
+func Load(path string) *List {
+	list := &List{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read %s: %s", path, err.Error())
+		}
+		return list
+	}
+	entries := []*Entry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Errorf("Unable to parse %s: %s", path, err.Error())
+		return list
+	}
+	for _, entry := range entries {
+		if err := entry.compile(); err != nil {
+			log.Errorf("Skipping ignore entry %s: %s", entry.Mask, err.Error())
+			continue
+		}
+		list.entries = append(list.entries, entry)
+	}
+	return list
+}
+
+func (list *List) save() {
+	data, err := json.MarshalIndent(list.entries, "", "  ")
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	tmp := list.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Unable to write %s: %s", tmp, err.Error())
+		return
+	}
+	if err := os.Rename(tmp, list.path); err != nil {
+		log.Errorf("Unable to write %s: %s", list.path, err.Error())
+	}
+}
+
+// Drop expired entries, returns true if there were any.
+func (list *List) expire() bool {
+	now := time.Now()
+	entries := list.entries[:0]
+	for _, entry := range list.entries {
+		if !entry.Expired(now) {
+			entries = append(entries, entry)
+		}
+	}
+	expired := len(entries) != len(list.entries)
+	list.entries = entries
+	return expired
+}
+
+// Add an entry, replacing any existing one with the same mask.
+func (list *List) Add(entry Entry) error {
+	if err := entry.compile(); err != nil {
+		return err
+	}
+	for _, scope := range entry.Scopes {
+		if !IsScope(scope) {
+			return fmt.Errorf("unknown scope '%s', use %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	list.expire()
+	for i, e := range list.entries {
+		if e.Mask == entry.Mask {
+			list.entries[i] = &entry
+			list.save()
+			return nil
+		}
+	}
+	list.entries = append(list.entries, &entry)
+	list.save()
+	return nil
+}
+
+func (list *List) Remove(mask string) bool {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	for i, entry := range list.entries {
+		if entry.Mask == mask {
+			list.entries = append(list.entries[:i], list.entries[i+1:]...)
+			list.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (list *List) Entries() []Entry {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	if list.expire() {
+		list.save()
+	}
+	entries := []Entry{}
+	for _, entry := range list.entries {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// Whether a line a user sent should be ignored for scope.
+func (list *List) Ignored(nick, user, host, text, scope string) bool {
+	hostmask := nick + "!" + user + "@" + host
+	now := time.Now()
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	for _, entry := range list.entries {
+		if entry.Expired(now) || !entry.Covers(scope) || !entry.expr.MatchString(hostmask) {
+			continue
+		}
+		if entry.text_expr == nil || entry.text_expr.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
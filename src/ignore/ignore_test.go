@@ -0,0 +1,155 @@
+package ignore
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		mask     string
+		hostmask string
+		match    bool
+	}{
+		{"Wipe", "Wipe!bot@example.com", true},
+		{"Wipe", "wipe!bot@example.com", true},
+		{"Wipe", "Wiper!bot@example.com", false},
+		{"*!*@*.example.com", "bob!b@host.example.com", true},
+		{"*!*@*.example.com", "bob!b@example.org", false},
+		{"bob!?@*", "bob!b@anywhere", true},
+		{"bob!?@*", "bob!bb@anywhere", false},
+		{"/^spam[0-9]+!/", "Spam42!x@y", true},
+		{"/^spam[0-9]+!/", "spammer!x@y", false},
+		{"a.b", "axb!x@y", false},
+	}
+	for _, test := range tests {
+		expr, err := Compile(test.mask)
+		if err != nil {
+			t.Errorf("%s: %s", test.mask, err.Error())
+			continue
+		}
+		if expr.MatchString(test.hostmask) != test.match {
+			t.Errorf("%s on %s: match %t, want %t", test.mask, test.hostmask, !test.match, test.match)
+		}
+	}
+	for _, mask := range []string{"", "/(/"} {
+		if _, err := Compile(mask); err == nil {
+			t.Errorf("%q compiled", mask)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	list := Load(filepath.Join(t.TempDir(), "ignore.json"))
+	entries := []Entry{
+		{Mask: "troll"},
+		{Mask: "relayed", Scopes: []string{Relay, Log}},
+		{Mask: "Wipe", Scopes: []string{Urls}, Text: "/Steam|YouTube/"},
+		{Mask: "gone", Expires: time.Now().Add(-time.Minute).Unix()},
+		{Mask: "spammer", Text: "buy  now"},
+	}
+	for _, entry := range entries {
+		if err := list.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		nick, text, scope string
+		ignored           bool
+	}{
+		{"troll", "hi", Commands, true},
+		{"troll", "hi", Urls, true},
+		{"relayed", "hi", Relay, true},
+		{"relayed", "hi", Commands, false},
+		{"Wipe", "[Steam] Portal 2 http://store.steampowered.com/app/620", Urls, true},
+		{"Wipe", "[YouTube] a video http://youtu.be/x", Urls, true},
+		{"Wipe", "look http://example.com", Urls, false},
+		{"Wipe", "[Steam] Portal 2", Commands, false},
+		{"gone", "hi", Commands, false},
+		{"someone", "hi", Commands, false},
+		{"spammer", "BUY  NOW at example.com", Commands, true},
+		{"spammer", "buy now", Commands, false},
+		{"spammer", "buy", Commands, false},
+	}
+	for _, test := range tests {
+		if got := list.Ignored(test.nick, "user", "host", test.text, test.scope); got != test.ignored {
+			t.Errorf("%s %q for %s: ignored %t, want %t", test.nick, test.text, test.scope, got, test.ignored)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		args    string
+		text    string
+		rest    string
+		problem string
+	}{
+		{"1d urls", "", "1d urls", ""},
+		{"text:spam", "spam", "", ""},
+		{"1d text:buy now  cheap", "buy now  cheap", "1d", ""},
+		{"urls text:/buy|sell/", "/buy|sell/", "urls", ""},
+		{`text:"buy now" 1d urls`, "buy now", "1d urls", ""},
+		{`1d text:"buy  now" urls`, "buy  now", "1d urls", ""},
+		{`text:"say "hi" there"`, `say "hi`, "there\"", ""},
+		{`text:"one"`, "one", "", ""},
+		{`text:"buy now`, "", "", "missing its closing quote"},
+		{`text:""`, "", "", "no text given"},
+		{"1d text:", "", "", "no text given"},
+	}
+	for _, test := range tests {
+		text, rest, err := SplitText(strings.Split(test.args, " "))
+		switch {
+		case test.problem == "" && err != nil:
+			t.Errorf("%q: unexpected error %s", test.args, err.Error())
+		case test.problem == "" && (text != test.text || strings.Join(rest, " ") != test.rest):
+			t.Errorf("%q: got text %q and %q, want %q and %q", test.args, text, rest, test.text, test.rest)
+		case test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)):
+			t.Errorf("%q: got %v, want an error about %s", test.args, err, test.problem)
+		}
+	}
+}
+
+func TestAddValidates(t *testing.T) {
+	list := Load(filepath.Join(t.TempDir(), "ignore.json"))
+	for _, entry := range []Entry{{Mask: ""}, {Mask: "x", Scopes: []string{"nonsense"}}, {Mask: "x", Text: "/(/"}} {
+		if err := list.Add(entry); err == nil {
+			t.Errorf("%+v was added", entry)
+		}
+	}
+	if len(list.Entries()) != 0 {
+		t.Errorf("entries were added: %v", list.Entries())
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ignore.json")
+	list := Load(path)
+	list.Add(Entry{Mask: "a", Text: "spam"})
+	list.Add(Entry{Mask: "b"})
+	list.Add(Entry{Mask: "a", Text: "eggs"})
+	if !list.Remove("b") || list.Remove("b") {
+		t.Error("Remove didn't remove b exactly once")
+	}
+
+	loaded := Load(path)
+	entries := loaded.Entries()
+	if len(entries) != 1 || entries[0].Mask != "a" || entries[0].Text != "eggs" {
+		t.Fatalf("loaded %v, want only a matching eggs", entries)
+	}
+	if !loaded.Ignored("a", "u", "h", "green eggs", Commands) || loaded.Ignored("a", "u", "h", "spam", Commands) {
+		t.Error("the loaded entry doesn't match its text")
+	}
+}
+
+func TestExpiredEntriesAreDropped(t *testing.T) {
+	list := Load(filepath.Join(t.TempDir(), "ignore.json"))
+	list.Add(Entry{Mask: "old", Expires: time.Now().Add(-time.Second).Unix()})
+	list.Add(Entry{Mask: "new", Expires: time.Now().Add(time.Hour).Unix()})
+	entries := list.Entries()
+	if len(entries) != 1 || entries[0].Mask != "new" {
+		t.Errorf("entries %v, want only new", entries)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	irc "github.com/fluffle/goirc/client"
+	"ignore"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const default_ignore_file = "ignore.json"
+
+var ignores *ignore.List
+
+func (cfg *Config) ignore_file() string {
+	if cfg.IgnoreFile == "" {
+		return default_ignore_file
+	}
+	return cfg.IgnoreFile
+}
+
+// What was hardcoded before there was an ignore list: Wipe, another bot, posting Steam
+// and YouTube links. Added when there's no ignore file yet, "%% ignore del Wipe" removes it.
+var default_ignores = []ignore.Entry{
+	{Mask: "Wipe", Scopes: []string{ignore.Urls}, Text: "/Steam|YouTube/"},
+}
+
+func load_ignores(path string) *ignore.List {
+	_, err := os.Stat(path)
+	fresh := os.IsNotExist(err)
+	list := ignore.Load(path)
+	if fresh {
+		for _, entry := range default_ignores {
+			if err := list.Add(entry); err != nil {
+				log.Errorf("Unable to add ignore entry %s: %s", entry.String(), err.Error())
+			}
+		}
+	}
+	return list
+}
+
+func ignored(line *irc.Line, scope string) bool {
+	return ignores != nil && ignores.Ignored(line.Nick, line.Ident, line.Host, line.Text(), scope)
+}
+
+// time.ParseDuration with days on top, e.g. "7d".
+func parse_expiry(s string) (time.Duration, bool) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, false
+		}
+		return time.Duration(days) * 24 * time.Hour, true
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil && d > 0
+}
+
+// Add an ignore entry for mask, args are an optional duration, list of scopes and text:<text>.
+func ignore_entry(ctx *CommandContext, mask string, args []string) (ignore.Entry, error) {
+	entry := ignore.Entry{Mask: mask, By: ctx.Sender}
+	text, args, err := ignore.SplitText(args)
+	if err != nil {
+		return entry, err
+	}
+	entry.Text = text
+	for _, arg := range args {
+		if d, ok := parse_expiry(arg); ok {
+			entry.Expires = time.Now().Add(d).Unix()
+			continue
+		}
+		entry.Scopes = append(entry.Scopes, strings.Split(arg, ",")...)
+	}
+	return entry, ignores.Add(entry)
+}
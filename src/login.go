@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	irc "github.com/fluffle/goirc/client"
+	"math"
+	"os"
+	"ratelimit"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hash_scheme           = "pbkdf2-sha256"
+	hash_iterations       = 100000
+	default_login_timeout = 60 // minutes
+)
+
+// Failed logins from a host before it has to wait, every attempt costs a full hash.
+var login_failure_limit = ratelimit.Limit{Count: 3, Seconds: 300}
+var login_failures = ratelimit.New()
+
+type LoginConfig struct {
+	Name string // Only needed with "login <name> <password>" when there are several logins.
+	Hash string // From zax -hash-password.
+	Role string // trusted, admin or owner.
+}
+
+// A logged in user, only valid from the hostmask they logged in from.
+type Session struct {
+	Name     string
+	Role     Role
+	Hostmask string
+	Expires  time.Time
+}
+
+type SessionList struct {
+	lock     sync.Mutex
+	sessions map[string]*Session // By lower case nick.
+}
+
+// PBKDF2 with HMAC-SHA256, see RFC 2898.
+func pbkdf2_sha256(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := []byte{}
+	for block := 1; len(key) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:length]
+}
+
+// Hashes look like pbkdf2-sha256$<iterations>$<salt>$<hash>, base64 encoded.
+func hash_password(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2_sha256([]byte(password), salt, hash_iterations, sha256.Size)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", hash_scheme, hash_iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func parse_hash(hash string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hash_scheme {
+		return 0, nil, nil, errors.New("not a " + hash_scheme + " hash, make one with -hash-password")
+	}
+	iterations, err = strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, errors.New("invalid iteration count")
+	}
+	enc := base64.RawStdEncoding
+	if salt, err = enc.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, errors.New("invalid salt")
+	}
+	if key, err = enc.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, errors.New("invalid hash")
+	}
+	return iterations, salt, key, nil
+}
+
+func check_password(hash, password string) bool {
+	iterations, salt, key, err := parse_hash(hash)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(key, pbkdf2_sha256([]byte(password), salt, iterations, len(key)))
+}
+
+// For -hash-password: reads a password from stdin and prints its hash.
+func print_password_hash() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	reader := bufio.NewReader(os.Stdin)
+	password, err := reader.ReadString('\n')
+	if err != nil && password == "" {
+		fmt.Fprintln(os.Stderr, "No password given.")
+		os.Exit(1)
+	}
+	hash, err := hash_password(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(hash)
+}
+
+func (cfg *Config) login_timeout() time.Duration {
+	if cfg.LoginTimeout <= 0 {
+		return default_login_timeout * time.Minute
+	}
+	return time.Duration(cfg.LoginTimeout) * time.Minute
+}
+
+func hostmask_of(nick, ident, host string) string {
+	return nick + "!" + ident + "@" + host
+}
+
+// The session of whoever sent the line, if it's still good.
+func (zax *ZAX) session(nick, hostmask string) *Session {
+	zax.sessions.lock.Lock()
+	defer zax.sessions.lock.Unlock()
+	session, ok := zax.sessions.sessions[strings.ToLower(nick)]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.Expires) || session.Hostmask != hostmask {
+		log.Noticef("Session of %s on %s is over.", session.Hostmask, zax.Name)
+		delete(zax.sessions.sessions, strings.ToLower(nick))
+		return nil
+	}
+	return session
+}
+
+func (zax *ZAX) end_session(nick string) {
+	zax.sessions.lock.Lock()
+	defer zax.sessions.lock.Unlock()
+	if session, ok := zax.sessions.sessions[strings.ToLower(nick)]; ok {
+		log.Noticef("Session of %s on %s ended.", session.Hostmask, zax.Name)
+		delete(zax.sessions.sessions, strings.ToLower(nick))
+	}
+}
+
+func (zax *ZAX) clear_sessions() {
+	zax.sessions.lock.Lock()
+	zax.sessions.sessions = make(map[string]*Session)
+	zax.sessions.lock.Unlock()
+}
+
+// Sessions end when the user quits, changes nick, or we lose the connection.
+func (zax *ZAX) setup_sessions(c *irc.Conn) {
+	zax.clear_sessions()
+	for _, event := range []string{irc.NICK, irc.QUIT} {
+		c.HandleFunc(event,
+			locked(func(conn *irc.Conn, line *irc.Line) {
+				zax.end_session(line.Nick)
+			}))
+	}
+	c.HandleFunc(irc.DISCONNECTED,
+		func(conn *irc.Conn, line *irc.Line) {
+			zax.clear_sessions()
+		})
+}
+
+// Whether a line is a login, which must not end up in the logs.
+func is_login(args []string, nick, prefix string) bool {
+	if len(args) > 0 && addresses(args[0], nick) {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return false
+	}
+	token := strings.ToLower(args[0])
+	return token == "login" || token == prefix+"login"
+}
+
+// login [ <name> ] <password>
+func cmd_login(ctx *CommandContext) {
+	if is_channel(ctx.Channel) {
+		ctx.Reply(ctx.Sender + ": Only log in through a private message. Change that password now.")
+		record_login(ctx, "refused, sent to a channel")
+		return
+	}
+	if len(ctx.Args) < 2 || len(config.Logins) == 0 {
+		ctx.Reply("Syntax: login [ <name> ] <password>")
+		return
+	}
+	rule := ratelimit.Rule{Key: ctx.Zax.Name + "/" + ctx.SenderHost, Limit: login_failure_limit}
+	if wait := login_failures.Wait(rule); wait > 0 {
+		log.Debugf("%s (%s) has too many failed logins, %s left.", ctx.Sender, ctx.SenderHost, wait)
+		ctx.Reply(fmt.Sprintf("Too many failed logins, try again in %ds.", int(math.Ceil(wait.Seconds()))))
+		return
+	}
+	login, password := find_login(config.Logins, ctx.Args[1:])
+	if login == nil {
+		ctx.Reply("Syntax: login <name> <password>")
+		return
+	}
+	if !check_password(login.Hash, password) {
+		login_failures.Allow(rule)
+		log.Warningf("Failed login by %s!%s@%s on %s.", ctx.Sender, ctx.Line.Ident, ctx.SenderHost, ctx.Zax.Name)
+		ctx.Reply("Wrong password.")
+		record_login(ctx, "wrong password")
+		return
+	}
+	role, _ := parse_role(login.Role)
+	session := &Session{login.Name, role, hostmask_of(ctx.Sender, ctx.Line.Ident, ctx.SenderHost),
+		time.Now().Add(config.login_timeout())}
+	ctx.Zax.sessions.lock.Lock()
+	ctx.Zax.sessions.sessions[strings.ToLower(ctx.Sender)] = session
+	ctx.Zax.sessions.lock.Unlock()
+	log.Noticef("%s logged in on %s as %s.", session.Hostmask, ctx.Zax.Name, role)
+	ctx.Reply(fmt.Sprintf("Logged in as %s until %s, or until you quit or change nick.", role, session.Expires.Format("15:04")))
+	record_login(ctx, "ok, "+role.String())
+}
+
+// Pick the login the arguments are for, so only its hash has to be checked.
+// Passwords may have spaces, so the first word is only a name if there's a login called that.
+// Otherwise it's the login without a name, or the only one there is.
+func find_login(logins []LoginConfig, args []string) (*LoginConfig, string) {
+	if len(args) > 1 {
+		for i := range logins {
+			if logins[i].Name != "" && logins[i].Name == args[0] {
+				return &logins[i], strings.Join(args[1:], " ")
+			}
+		}
+	}
+	password := strings.Join(args, " ")
+	if len(logins) == 1 {
+		return &logins[0], password
+	}
+	for i := range logins {
+		if logins[i].Name == "" {
+			return &logins[i], password
+		}
+	}
+	return nil, ""
+}
+
+func cmd_logout(ctx *CommandContext) {
+	if ctx.Zax.session(ctx.Sender, hostmask_of(ctx.Sender, ctx.Line.Ident, ctx.SenderHost)) == nil {
+		ctx.Reply("You're not logged in.")
+		return
+	}
+	ctx.Zax.end_session(ctx.Sender)
+	ctx.Reply("Logged out.")
+}
+
+// Logins go to the audit log, without the password.
+func record_login(ctx *CommandContext, outcome string) {
+	args := ctx.Args
+	ctx.Args = []string{"login"}
+	record_audit(ctx, outcome)
+	ctx.Args = args
+}
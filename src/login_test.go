@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFindLogin(t *testing.T) {
+	logins := []LoginConfig{{Name: "alice"}, {Name: ""}, {Name: "bob"}}
+	tests := []struct {
+		logins   []LoginConfig
+		args     string
+		name     string
+		password string
+		found    bool
+	}{
+		{logins, "alice secret", "alice", "secret", true},
+		{logins, "bob two words", "bob", "two words", true},
+		{logins, "alice", "", "alice", true},
+		{logins, "carol secret", "", "carol secret", true},
+		{logins[:1], "secret", "alice", "secret", true},
+		{logins[:1], "alice secret", "alice", "secret", true},
+		{[]LoginConfig{{Name: "alice"}, {Name: "bob"}}, "secret", "", "", false},
+	}
+	for _, test := range tests {
+		login, password := find_login(test.logins, strings.Fields(test.args))
+		if (login != nil) != test.found {
+			t.Errorf("%q: found %t, want %t", test.args, login != nil, test.found)
+			continue
+		}
+		if login != nil && (login.Name != test.name || password != test.password) {
+			t.Errorf("%q: got %q with %q, want %q with %q", test.args, login.Name, password, test.name, test.password)
+		}
+	}
+}
+
+// PBKDF2-HMAC-SHA256 test vector from RFC 7914.
+func TestPbkdf2(t *testing.T) {
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got := hex.EncodeToString(pbkdf2_sha256([]byte("passwd"), []byte("salt"), 1, 64)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	enc := base64.RawStdEncoding
+	salt := []byte("0123456789abcdef")
+	key := pbkdf2_sha256([]byte("hunter2"), salt, 10, 32)
+	hash := fmt.Sprintf("%s$10$%s$%s", hash_scheme, enc.EncodeToString(salt), enc.EncodeToString(key))
+	tests := []struct {
+		hash, password string
+		ok             bool
+	}{
+		{hash, "hunter2", true},
+		{hash, "hunter3", false},
+		{hash, "", false},
+		{"md5$10$x$y", "hunter2", false},
+		{hash_scheme + "$0$" + enc.EncodeToString(salt) + "$" + enc.EncodeToString(key), "hunter2", false},
+	}
+	for _, test := range tests {
+		if got := check_password(test.hash, test.password); got != test.ok {
+			t.Errorf("%s with %q: %t, want %t", test.hash, test.password, got, test.ok)
+		}
+	}
+}
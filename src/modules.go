@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"news"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// A handler module that can be switched on and off with Config.Handlers.
+// Settings points to the struct that the module's block in Config.Modules is decoded into.
+type Module struct {
+	Name     string
+	Settings interface{}
+	Register func(registry *CommandRegistry)
+}
+
+type SteamSettings struct {
+	UserAgent   string
+	RandomPages int // Number of pages in the "newest releases" listing to pick random games from.
+}
+
+type GamesSettings struct {
+	UserAgent string
+}
+
+type RedditSettings struct {
+	SkipRepeats bool // Don't look up the same URL twice in a row.
+}
+
+type NewsSettings struct {
+	Channels []string // "#chan" or "network/#chan" to announce new headlines in, every channel if empty.
+	Interval int      // Minutes between polls.
+	State    string   // File that remembers which items have been announced.
+	Count    int      // Number of items listed by .news.
+}
+
+var steam_settings SteamSettings
+var games_settings GamesSettings
+var reddit_settings RedditSettings
+var news_settings NewsSettings
+
+var modules = []*Module{
+	{"games", &games_settings, register_games},
+	{"random", nil, register_random},
+	{"steam", &steam_settings, register_steam},
+	{"history", nil, register_history},
+	{"seen", nil, register_seen},
+	{"reddit", &reddit_settings, nil},
+	{"news", &news_settings, register_news},
+}
+
+var enabled_modules map[string]bool
+
+// Settings of the modules that have them, before the config's Modules are decoded into them.
+func default_module_settings(cfg *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"steam":  &SteamSettings{cfg.UserAgent, 285},
+		"games":  &GamesSettings{cfg.UserAgent},
+		"reddit": &RedditSettings{true},
+		"news":   &NewsSettings{nil, 15, "news.json", 3},
+	}
+}
+
+func find_module(name string) *Module {
+	for _, module := range modules {
+		if module.Name == name {
+			return module
+		}
+	}
+	return nil
+}
+
+func module_enabled(name string) bool {
+	return enabled_modules[name]
+}
+
+// The modules of a config, loaded without touching the ones in use. use puts them in place.
+type LoadedModules struct {
+	enabled  map[string]bool
+	settings map[string]interface{} // Same types as Module.Settings, by module name.
+	registry *CommandRegistry
+}
+
+// Decode the settings of every module listed in Config.Handlers and register its commands.
+// When Handlers is missing from the config entirely every module is loaded.
+func load_modules(cfg *Config) (*LoadedModules, error) {
+	loaded := &LoadedModules{make(map[string]bool), default_module_settings(cfg), NewCommandRegistry()}
+
+	names := cfg.Handlers
+	if names == nil {
+		log.Notice("No handlers configured, loading all modules.")
+		for _, module := range modules {
+			names = append(names, module.Name)
+		}
+	}
+	for _, name := range names {
+		module := find_module(name)
+		if module == nil {
+			return nil, fmt.Errorf("unknown handler '%s'", name)
+		}
+		if raw, ok := cfg.Modules[name]; ok && module.Settings != nil {
+			if err := json.Unmarshal(raw, loaded.settings[name]); err != nil {
+				return nil, fmt.Errorf("invalid settings for handler '%s': %s", name, err.Error())
+			}
+		}
+		loaded.enabled[name] = true
+	}
+	for _, module := range modules {
+		if !loaded.enabled[module.Name] {
+			log.Infof("Module %s is disabled.", module.Name)
+			continue
+		}
+		log.Infof("Loading module %s.", module.Name)
+		if module.Register != nil {
+			module.Register(loaded.registry)
+		}
+	}
+	register_core_commands(loaded.registry)
+	return loaded, nil
+}
+
+// Switch the settings, the enabled modules and the commands over to what was loaded.
+func (loaded *LoadedModules) use() {
+	for _, module := range modules {
+		if module.Settings != nil {
+			reflect.ValueOf(module.Settings).Elem().Set(reflect.ValueOf(loaded.settings[module.Name]).Elem())
+		}
+	}
+	enabled_modules = loaded.enabled
+	commands = loaded.registry
+}
+
+func register_games(registry *CommandRegistry) {
+	registry.Register(&SimpleCommand{
+		Trigger: "g",
+		Alias:   []string{"game"},
+		Help:    "Search for game info. Syntax: {p}game <query>",
+		Remote:  true,
+		Func:    cmd_game,
+	})
+}
+
+func register_random(registry *CommandRegistry) {
+	registry.Register(&SimpleCommand{
+		Trigger: "r",
+		Alias:   []string{"random"},
+		Help:    "Generate random number. Syntax: {p}random <min> <max>",
+		Func:    cmd_random,
+	})
+}
+
+func register_steam(registry *CommandRegistry) {
+	registry.Register(&SimpleCommand{
+		Trigger: "s",
+		Alias:   []string{"steam"},
+		Help:    "Search steam. For result symbols type '{p}help s symbols' Syntax: {p}steam [ find | latest | random | trending | appid] <expression>",
+		Topics: map[string]string{
+			"symbols": "MP=MultiPlayer, SP=SinglePlayer, CO=Co-op VAC=Valve Anti-Cheat, TC=Trading Card, Ach=Achievments, EA=Early Access, WS=Workshop support",
+		},
+		Remote: true,
+		Func:   cmd_steam,
+	})
+}
+
+// Help topics shared by the history commands.
+func history_topics(cmd string) map[string]string {
+	topics := map[string]string{
+		"search": "A search can have from:nick, in:#chan, net:<network> (net:* or --all for every network), " +
+			"since:3d or since:2015-06-01, before:<date or age>, has:url, words, \"a phrase\" and -word to exclude. " +
+			"Words match as they are, use a /regex/ or --regex for a regular expression. Example: {p}msg find from:bob since:1w \"free pizza\" -cold",
+		"find": "Syntax: {p}<cmd> find <search> -- newest match first, {p}next and {p}prev for the others, {p}context for what was said around it. " +
+			"For messages the words can also use OR, NOT and ( ), and --relevant puts the best matches first.",
+		"last":   "Syntax: {p}<cmd> last [ <search> ] -- the newest match, e.g. {p}<cmd> last from:bob",
+		"random": "Syntax: {p}<cmd> random [ <search> ] -- a random match, e.g. {p}<cmd> random in:#chan since:1y",
+	}
+	for name, text := range topics {
+		topics[name] = strings.Replace(text, "<cmd>", cmd, -1)
+	}
+	return topics
+}
+
+func register_history(registry *CommandRegistry) {
+	registry.Register(&SimpleCommand{
+		Trigger: "u",
+		Alias:   []string{"url"},
+		Help:    "Search URL log. Syntax: {p}url [ find | last | random ] <search> -- {p}help url search for the syntax.",
+		Topics:  history_topics("url"),
+		Func:    cmd_url,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "m",
+		Alias:   []string{"msg"},
+		Help:    "Search message log. Syntax: {p}msg [ find | last | random ] <search> -- {p}help msg search for the syntax.",
+		Topics:  history_topics("msg"),
+		Func:    cmd_msg,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "ev",
+		Alias:   []string{"event"},
+		Help:    "Search joins and quits. Syntax: {p}event [ find | last | random ] <search> -- {p}help event search for the syntax.",
+		Topics:  history_topics("event"),
+		Func:    cmd_event,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "next",
+		Help:    "The next result of your last msg, url or event search in this channel. Syntax: {p}next",
+		Func:    cmd_next,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "prev",
+		Help:    "The previous result of your last search. Syntax: {p}prev",
+		Func:    cmd_prev,
+	})
+	registry.Register(&SimpleCommand{
+		Trigger: "context",
+		Help:    "What was said around the search result shown last. Syntax: {p}context [ <lines> ]",
+		Lines:   2*max_context_line + 1,
+		Func:    cmd_context,
+	})
+}
+
+func register_seen(registry *CommandRegistry) {
+	registry.Register(&SimpleCommand{
+		Trigger: "seen",
+		Special: "!",
+		Help:    "Checks when user was last seen, net:* checks every network. Syntax: !<username> [ net:<network> | net:* ] or {p}seen <username> [ net:<network> | net:* ]",
+		Glued:   true,
+		Func:    cmd_seen,
+	})
+}
+
+func register_news(registry *CommandRegistry) {
+	registry.Register(&SimpleCommand{
+		Trigger: "n",
+		Alias:   []string{"news"},
+		Help:    "Show the latest headlines from the news feeds. Syntax: {p}news [ <count> ]",
+		Func:    cmd_news,
+	})
+}
+
+// What the news poller was started with, it's only replaced when this changes.
+type news_setup struct {
+	Feeds     []string
+	Interval  int
+	UserAgent string
+	State     string
+}
+
+var running_news news_setup
+
+// Polls the configured feeds while the news module is enabled, replacing the poller
+// when the feeds or their settings changed. Called by main without config_lock held:
+// stopping waits for a poll that's running, which may be waiting for the lock to announce.
+func update_news() {
+	config_lock.RLock()
+	want := news_setup{}
+	if module_enabled("news") && len(config.News) > 0 {
+		want = news_setup{config.News, news_settings.Interval, config.UserAgent, news_settings.State}
+		if want.Interval < 1 {
+			want.Interval = 1
+		}
+	}
+	config_lock.RUnlock()
+	if reflect.DeepEqual(want, running_news) {
+		return
+	}
+
+	config_lock.Lock()
+	old := news_poller
+	news_poller = nil
+	config_lock.Unlock()
+	// The new poller reads the state file, the old one has to be done writing it.
+	if old != nil {
+		old.Stop()
+	}
+	running_news = want
+	if len(want.Feeds) == 0 {
+		return
+	}
+	poller := news.NewPoller(want.Feeds, time.Duration(want.Interval)*time.Minute, want.UserAgent, want.State, announce_news)
+	poller.Start()
+	config_lock.Lock()
+	news_poller = poller
+	config_lock.Unlock()
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/tls"
+	"flood"
+	"fmt"
+	client "github.com/fluffle/goirc/client"
+	irc "github.com/fluffle/goirc/client"
+	"github.com/mvdan/xurls"
+	records "history"
+	"ignore"
+	"reddit"
+	"strings"
+	"sync"
+)
+
+type NetworkConfig struct {
+	Name              string // Recorded in the history, keep it stable.
+	Username          string
+	Nickname          string
+	Server            string
+	Servers           []string // Rotated through on reconnect, Server is used if empty.
+	ReportChan        string
+	SSL               bool
+	SSLIgnoreInsecure bool
+	CertFile          string // TLS client certificate, needed for SASL EXTERNAL.
+	KeyFile           string
+	Sasl              SaslConfig
+	NickServ          NickServConfig // Used when SASL isn't configured or failed.
+	ReclaimInterval   int            // Seconds between attempts to get Nickname back, negative disables it.
+	Channels          []ChannelCredentials
+}
+
+// One IRC connection.
+type ZAX struct {
+	Name         string
+	Config       NetworkConfig
+	IrcConfig    *client.Config
+	IrcClient    *client.Conn
+	queue        *flood.Queue
+	quitting     bool      // Set when we quit on purpose, so we don't reconnect.
+	quit         chan bool // Closed when quitting is set, wakes ConnectLoop up from the backoff.
+	attempts     int       // Connection attempts since the last welcome, quitting and attempts are guarded by conn_lock.
+	conn_lock    sync.Mutex
+	server_index int
+	disconnected chan *ZAX // Told when the connection is gone, or when ConnectLoop gave up because we quit.
+	sasl_done    bool      // SASL succeeded, failed or isn't used.
+	identified   bool
+	joined       bool
+	accounts     map[string]string
+	account_lock sync.Mutex
+	join_waiters map[string]*join_waiter // Channels joined with "%% join", by lower case name.
+	join_lock    sync.Mutex
+	sessions     SessionList
+}
+
+var networks []*ZAX
+
+// Networks from the config. Configs from before Networks existed describe a single
+// network with the top level fields, that one is called "default".
+func network_configs() []NetworkConfig {
+	if len(config.Networks) > 0 {
+		return config.Networks
+	}
+	net := config.NetworkConfig
+	if net.Name == "" {
+		net.Name = "default"
+	}
+	return []NetworkConfig{net}
+}
+
+func find_network(name string) *ZAX {
+	for _, zax := range networks {
+		if zax.Name == name {
+			return zax
+		}
+	}
+	return nil
+}
+
+// Network that history records without a network name belong to.
+func default_network() string {
+	return network_configs()[0].Name
+}
+
+// Queue a message, it's sent once the flood limits allow it.
+func (zax *ZAX) Privmsg(t, msg string) {
+	zax.PrivmsgPriority(t, msg, flood.Normal)
+}
+
+func (zax *ZAX) PrivmsgPriority(t, msg string, priority flood.Priority) {
+	zax.queue_lines(t, msg, priority, 0)
+}
+
+// Relayed traffic, which gives way to everything else and is merged or dropped when it backs up.
+func (zax *ZAX) Relay(t, msg string) {
+	zax.PrivmsgPriority(t, msg, flood.Low)
+}
+
+func (zax *ZAX) send(t, msg string) {
+	log.Debugf("Privmsg: [%s/%s] %s", zax.Name, t, msg)
+	zax.IrcClient.Privmsg(t, msg)
+}
+
+func (zax *ZAX) apply_flood_config(limits FloodConfig) {
+	zax.queue.SetLimits(limits.Rate, limits.Burst, limits.MaxQueue)
+}
+
+func (zax *ZAX) Quit(msg string) {
+	log.Debugf("Quit: [%s] %s", zax.Name, msg)
+	zax.conn_lock.Lock()
+	if !zax.quitting {
+		zax.quitting = true
+		close(zax.quit)
+	}
+	zax.conn_lock.Unlock()
+	zax.IrcClient.Quit(msg)
+}
+
+func (zax *ZAX) is_quitting() bool {
+	zax.conn_lock.Lock()
+	defer zax.conn_lock.Unlock()
+	return zax.quitting
+}
+
+func quit_all(msg string) {
+	for _, zax := range networks {
+		zax.Quit(msg)
+	}
+}
+
+func NewZAX(net NetworkConfig, disconnected chan *ZAX) (*ZAX, error) {
+	zax := &ZAX{Name: net.Name, Config: net, quit: make(chan bool), disconnected: disconnected}
+
+	log.Noticef("Creating IRC cfg for %s. Server: %s, Use SSL: %t, Nickname %s", net.Name, net.Server, net.SSL, net.Nickname)
+	ident := "ZAX"
+	if net.Username != "" {
+		ident = net.Username
+	}
+	cfg := irc.NewConfig(net.Nickname)
+	cfg.SSL = net.SSL
+	cfg.SSLConfig = &tls.Config{}
+	cfg.SSLConfig.InsecureSkipVerify = net.SSLIgnoreInsecure
+	if net.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(net.CertFile, net.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate for %s: %s", net.Name, err.Error())
+		}
+		cfg.SSLConfig.Certificates = []tls.Certificate{cert}
+	}
+	cfg.Me.Ident = ident
+	cfg.Me.Name = "ZAX"
+	cfg.Version = "ZAX"
+	cfg.Server = net.Server
+	cfg.NewNick = func(n string) string { return n + "^" }
+	// CAP LS goes out before NICK and USER, see setup_auth.
+	cfg.EnableCapabilityNegotiation = true
+	cfg.Capabilites = wanted_caps
+	cfg.Sasl = net.sasl_client()
+	c := irc.Client(cfg)
+	c.EnableStateTracking()
+	zax.IrcClient = c
+	zax.IrcConfig = cfg
+	limits := config.FloodLimits()
+	zax.queue = flood.NewQueue(limits.Rate, limits.Burst, limits.MaxQueue, zax.send, c.Connected)
+	zax.queue.MergeLimit = zax.line_budget(net.ReportChan)
+	go zax.queue.Run()
+
+	c.HandleFunc(irc.CONNECTED,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			zax.conn_lock.Lock()
+			zax.attempts = 0
+			zax.conn_lock.Unlock()
+		}))
+	c.HandleFunc(irc.DISCONNECTED,
+		func(conn *irc.Conn, line *irc.Line) {
+			log.Noticef("Disconnected from %s", zax.Name)
+			if n := zax.queue.Len(); n > 0 {
+				log.Noticef("Dropping %d queued messages for %s.", n, zax.Name)
+				zax.queue.Clear()
+			}
+			zax.disconnected <- zax
+		})
+	c.HandleFunc(irc.JOIN,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			log.Infof("[%s/%s] %s (%s@%s) has joined.", zax.Name, line.Target(), line.Nick, line.Ident, line.Host)
+			if !ignored(line, ignore.Log) {
+				history.AddEvent(zax.Name, line.Nick, "join", "", line.Target())
+			}
+		}))
+	c.HandleFunc(irc.QUIT,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			log.Infof("[%s/%s] %s (%s@%s) has quit.", zax.Name, line.Target(), line.Nick, line.Ident, line.Host)
+			if !ignored(line, ignore.Log) {
+				history.AddEvent(zax.Name, line.Nick, "quit", line.Text(), "")
+			}
+		}))
+	c.HandleFunc(irc.PING,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			log.Debug("PING.")
+		}))
+	c.HandleFunc(irc.PRIVMSG, locked(zax.handle_privmsg))
+	zax.setup_auth(c)
+	zax.setup_accounts(c)
+	zax.setup_join_replies(c)
+	zax.setup_sessions(c)
+	zax.setup_reclaim(c)
+	return zax, nil
+}
+
+func (zax *ZAX) handle_privmsg(conn *irc.Conn, line *irc.Line) {
+	sender_host := line.Host
+	sender := line.Nick
+	text := line.Text()
+	channel := line.Target()
+	target := line.Target()
+	reply_to := line.Target()
+
+	if strings.EqualFold(line.Target(), zax.current_nick()) {
+		reply_to = sender
+	}
+	// Remove control characters
+	text = strings.Replace(text, "\x02", "", -1)
+	text = strings.Replace(text, "\x03", "", -1)
+
+	scope := option_scope(zax, channel)
+	logged := redact_line(text, zax.current_nick(), opts.Get("command_prefix", scope))
+	log.Noticef("[%s/%s] %s: %s", zax.Name, target, sender, logged)
+
+	var record *records.Record
+	if !ignored(line, ignore.Log) {
+		record = history.AddMessage(zax.Name, sender, target, logged)
+	}
+	if len(zax.Config.ReportChan) > 0 && opts.Bool("report_relay", scope) && !ignored(line, ignore.Relay) {
+		zax.Relay(zax.Config.ReportChan, fmt.Sprintf("[%s] %s: %s", target, sender, logged))
+	}
+
+	if !ignored(line, ignore.Commands) {
+		args := strings.Split(text, " ")
+		ctx := &CommandContext{
+			Zax:        zax,
+			Conn:       conn,
+			Line:       line,
+			Sender:     sender,
+			SenderHost: sender_host,
+			Channel:    channel,
+			ReplyTo:    reply_to,
+			Text:       text,
+			Args:       args,
+			Account:    zax.account_of(line),
+			Logged:     record,
+			Priority:   flood.Normal,
+		}
+		commands.Dispatch(ctx)
+	}
+
+	// Handle URLs
+	if opts.Bool("process_urls", scope) && !ignored(line, ignore.Urls) {
+		log.Debug("Looking for URLs...")
+		urls := xurls.Relaxed.FindAllString(text, -1)
+		for i := 0; i < len(urls); i++ {
+			url := urls[i]
+			log.Debugf("Found reddit url: %s", url)
+			if !ignored(line, ignore.Log) {
+				history.AddUrl(zax.Name, sender, target, url)
+			}
+
+			if !module_enabled("reddit") || !opts.Bool("reddit_lookup", scope) {
+				continue
+			}
+			if opts.Bool("skip_repeats", scope) && url == last_url {
+				log.Debugf("Matches same url (%s) as last time, ignore.", last_url)
+				continue
+			}
+			reddit, success := reddit.Search(url)
+			if success {
+				zax.Privmsg(reply_to, reddit)
+			} else {
+				log.Debug("Failed to retrieve reddit URL for the link.")
+			}
+			last_url = url
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package news
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logging.MustGetLogger("news")
+
+// How long ids are remembered after they were last seen in a feed.
+const seen_expiry = 60 * 24 * time.Hour
+
+type Item struct {
+	Id        string
+	Title     string
+	Link      string
+	Feed      string // Title of the feed the item came from.
+	Published time.Time
+}
+
+type rss_doc struct {
+	Channel struct {
+		Title string     `xml:"title"`
+		Items []rss_item `xml:"item"`
+	} `xml:"channel"`
+	Items []rss_item `xml:"item"` // RSS 1.0 (RDF) keeps the items outside of the channel.
+}
+
+type rss_item struct {
+	Title   string `xml:"title"`
+	Link    string `xml:"link"`
+	Guid    string `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+	Date    string `xml:"date"`
+}
+
+type atom_doc struct {
+	Title   string       `xml:"title"`
+	Entries []atom_entry `xml:"entry"`
+}
+
+type atom_entry struct {
+	Title string `xml:"title"`
+	Id    string `xml:"id"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Updated   string `xml:"updated"`
+	Published string `xml:"published"`
+}
+
+var date_formats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2006-01-02T15:04:05Z0700",
+}
+
+func parse_date(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, format := range date_formats {
+		t, err := time.Parse(format, s)
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Parse an RSS 2.0, RSS 1.0 or Atom document.
+func Parse(data []byte) ([]Item, bool) {
+	var root struct {
+		XMLName xml.Name
+	}
+	err := xml.Unmarshal(data, &root)
+	if err != nil {
+		log.Debugf("Unable to parse feed: %s", err.Error())
+		return nil, false
+	}
+	items := []Item{}
+
+	switch strings.ToLower(root.XMLName.Local) {
+	case "rss", "rdf":
+		doc := rss_doc{}
+		if err := xml.Unmarshal(data, &doc); err != nil {
+			log.Debugf("Unable to parse RSS feed: %s", err.Error())
+			return nil, false
+		}
+		for _, entry := range append(doc.Channel.Items, doc.Items...) {
+			id := entry.Guid
+			if id == "" {
+				id = entry.Link
+			}
+			if id == "" {
+				id = entry.Title
+			}
+			date := entry.PubDate
+			if date == "" {
+				date = entry.Date
+			}
+			items = append(items, Item{id, clean(entry.Title), strings.TrimSpace(entry.Link), clean(doc.Channel.Title), parse_date(date)})
+		}
+	case "feed":
+		doc := atom_doc{}
+		if err := xml.Unmarshal(data, &doc); err != nil {
+			log.Debugf("Unable to parse Atom feed: %s", err.Error())
+			return nil, false
+		}
+		for _, entry := range doc.Entries {
+			link := ""
+			for _, l := range entry.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					link = l.Href
+					break
+				}
+			}
+			id := entry.Id
+			if id == "" {
+				id = link
+			}
+			date := entry.Published
+			if date == "" {
+				date = entry.Updated
+			}
+			items = append(items, Item{id, clean(entry.Title), link, clean(doc.Title), parse_date(date)})
+		}
+	default:
+		log.Debugf("Unknown feed type '%s'.", root.XMLName.Local)
+		return nil, false
+	}
+	return items, true
+}
+
+func Fetch(url string, useragent string) ([]Item, bool) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, false
+	}
+	req.Header.Set("User-Agent", useragent)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("Fetching %s failed: %s", url, resp.Status)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, false
+	}
+	return Parse(body)
+}
+
+// Item ids that have already been announced, persisted as JSON so restarts don't repeat headlines.
+type Seen struct {
+	path  string
+	Feeds map[string]map[string]int64 // feed url -> item id -> last seen (unix)
+}
+
+func LoadSeen(path string) *Seen {
+	seen := &Seen{path, make(map[string]map[string]int64)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read %s: %s", path, err.Error())
+		}
+		return seen
+	}
+	if err := json.Unmarshal(data, &seen.Feeds); err != nil {
+		log.Errorf("Unable to parse %s: %s", path, err.Error())
+		seen.Feeds = make(map[string]map[string]int64)
+	}
+	return seen
+}
+
+func (seen *Seen) Known(feed string) bool {
+	_, ok := seen.Feeds[feed]
+	return ok
+}
+
+func (seen *Seen) Has(feed, id string) bool {
+	_, ok := seen.Feeds[feed][id]
+	return ok
+}
+
+func (seen *Seen) Add(feed, id string) {
+	if _, ok := seen.Feeds[feed]; !ok {
+		seen.Feeds[feed] = make(map[string]int64)
+	}
+	seen.Feeds[feed][id] = time.Now().Unix()
+}
+
+func (seen *Seen) Save() {
+	expired := time.Now().Add(-seen_expiry).Unix()
+	for _, ids := range seen.Feeds {
+		for id, ts := range ids {
+			if ts < expired {
+				delete(ids, id)
+			}
+		}
+	}
+	data, err := json.Marshal(seen.Feeds)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	tmp := seen.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Unable to write %s: %s", tmp, err.Error())
+		return
+	}
+	if err := os.Rename(tmp, seen.path); err != nil {
+		log.Errorf("Unable to write %s: %s", seen.path, err.Error())
+	}
+}
+
+// Polls a set of feeds and calls Announce for every item that hasn't been seen before.
+// Items of a feed that is polled for the first time are only remembered, not announced.
+type Poller struct {
+	Feeds     []string
+	Interval  time.Duration
+	UserAgent string
+	Announce  func(item Item)
+
+	seen   *Seen
+	latest []Item
+	lock   sync.Mutex
+	stop   chan bool
+	done   chan bool // Closed once the polling goroutine is gone.
+}
+
+func NewPoller(feeds []string, interval time.Duration, useragent, state string, announce func(item Item)) *Poller {
+	return &Poller{
+		Feeds:     feeds,
+		Interval:  interval,
+		UserAgent: useragent,
+		Announce:  announce,
+		seen:      LoadSeen(state),
+		latest:    []Item{},
+		stop:      make(chan bool),
+		done:      make(chan bool),
+	}
+}
+
+func (poller *Poller) Start() {
+	go func() {
+		defer close(poller.done)
+		poller.Poll()
+		ticker := time.NewTicker(poller.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				poller.Poll()
+			case <-poller.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops polling and waits for a poll that's running, which gives up on what it fetched.
+// Only for pollers that were started.
+func (poller *Poller) Stop() {
+	close(poller.stop)
+	<-poller.done
+}
+
+func (poller *Poller) stopped() bool {
+	select {
+	case <-poller.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (poller *Poller) Poll() {
+	// Fetch before taking the lock, Latest shouldn't wait for slow feeds.
+	fetched := make(map[string][]Item)
+	for _, feed := range poller.Feeds {
+		if poller.stopped() {
+			return
+		}
+		items, success := Fetch(feed, poller.UserAgent)
+		if !success {
+			log.Warningf("Failed to fetch feed %s.", feed)
+			continue
+		}
+		log.Debugf("Fetched %d items from %s.", len(items), feed)
+		fetched[feed] = items
+	}
+
+	if poller.stopped() {
+		return
+	}
+	latest := []Item{}
+	fresh := []Item{}
+	poller.lock.Lock()
+	for _, feed := range poller.Feeds {
+		items, ok := fetched[feed]
+		if !ok {
+			continue
+		}
+		priming := !poller.seen.Known(feed)
+		for _, item := range items {
+			if !poller.seen.Has(feed, item.Id) && !priming {
+				fresh = append(fresh, item)
+			}
+			poller.seen.Add(feed, item.Id)
+		}
+		if priming && len(items) == 0 {
+			poller.seen.Feeds[feed] = make(map[string]int64)
+		}
+		latest = append(latest, items...)
+	}
+	sort.SliceStable(latest, func(i, j int) bool { return latest[i].Published.After(latest[j].Published) })
+	poller.latest = latest
+	poller.seen.Save()
+	poller.lock.Unlock()
+
+	// Oldest first, so the channel reads in order.
+	sort.SliceStable(fresh, func(i, j int) bool { return fresh[i].Published.Before(fresh[j].Published) })
+	for _, item := range fresh {
+		if poller.stopped() {
+			return
+		}
+		poller.Announce(item)
+	}
+}
+
+// The n most recent items from the last poll.
+func (poller *Poller) Latest(n int) []Item {
+	poller.lock.Lock()
+	defer poller.lock.Unlock()
+	if n > len(poller.latest) {
+		n = len(poller.latest)
+	}
+	return append([]Item{}, poller.latest[:n]...)
+}
@@ -0,0 +1,239 @@
+package news
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const rss_head = `<?xml version="1.0"?><rss version="2.0"><channel><title>Test feed</title>`
+
+func rss_feed(ids ...string) string {
+	items := []string{}
+	for i, id := range ids {
+		date := time.Date(2015, 6, 1, 12, i, 0, 0, time.UTC).Format(time.RFC1123Z)
+		items = append(items, fmt.Sprintf("<item><title>Item %s</title><link>http://example.com/%s</link><guid>%s</guid><pubDate>%s</pubDate></item>", id, id, id, date))
+	}
+	return rss_head + strings.Join(items, "") + "</channel></rss>"
+}
+
+const atom_feed = `<?xml version="1.0"?><feed xmlns="http://www.w3.org/2005/Atom"><title>Atom feed</title>
+<entry><title>First</title><id>urn:1</id><link href="http://example.com/1"/><updated>2015-06-01T12:00:00Z</updated></entry>
+<entry><title>Second</title><id>urn:2</id><link rel="alternate" href="http://example.com/2"/><published>2015-06-02T12:00:00Z</published></entry>
+</feed>`
+
+// A feed server whose body can be swapped between polls, "" answers with a 500.
+type feed_server struct {
+	*httptest.Server
+	lock sync.Mutex
+	body string
+}
+
+func new_feed_server(body string) *feed_server {
+	fs := &feed_server{body: body}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		if fs.body == "" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fs.body))
+	}))
+	return fs
+}
+
+func (fs *feed_server) set(body string) {
+	fs.lock.Lock()
+	fs.body = body
+	fs.lock.Unlock()
+}
+
+func new_test_poller(t *testing.T, feeds ...string) (*Poller, *[]Item) {
+	announced := &[]Item{}
+	state := filepath.Join(t.TempDir(), "news.json")
+	poller := NewPoller(feeds, time.Hour, "test", state, func(item Item) {
+		*announced = append(*announced, item)
+	})
+	return poller, announced
+}
+
+func ids(items []Item) string {
+	s := []string{}
+	for _, item := range items {
+		s = append(s, item.Id)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		feed  string
+		ids   string
+		title string
+		ok    bool
+	}{
+		{"rss", rss_feed("a", "b"), "a,b", "Test feed", true},
+		{"atom", atom_feed, "urn:1,urn:2", "Atom feed", true},
+		{"rdf", `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><channel><title>RDF</title></channel>` +
+			`<item><title>x</title><link>http://example.com/x</link></item></rdf:RDF>`, "http://example.com/x", "RDF", true},
+		{"unknown root", `<html></html>`, "", "", false},
+		{"not xml", `{"json": true}`, "", "", false},
+	}
+	for _, test := range tests {
+		items, ok := Parse([]byte(test.feed))
+		if ok != test.ok {
+			t.Errorf("%s: ok = %t, want %t", test.name, ok, test.ok)
+			continue
+		}
+		if got := ids(items); got != test.ids {
+			t.Errorf("%s: ids = %s, want %s", test.name, got, test.ids)
+		}
+		if len(items) > 0 && items[0].Feed != test.title {
+			t.Errorf("%s: feed title = %q, want %q", test.name, items[0].Feed, test.title)
+		}
+	}
+}
+
+func TestPollPrimesNewFeeds(t *testing.T) {
+	server := new_feed_server(rss_feed("a", "b"))
+	defer server.Close()
+	poller, announced := new_test_poller(t, server.URL)
+
+	poller.Poll()
+	if len(*announced) != 0 {
+		t.Errorf("first poll announced %s, a new feed should only be remembered", ids(*announced))
+	}
+	if got := ids(poller.Latest(10)); got != "b,a" {
+		t.Errorf("Latest = %s, want b,a", got)
+	}
+}
+
+func TestPollAnnouncesOnlyNewItems(t *testing.T) {
+	server := new_feed_server(rss_feed("a", "b"))
+	defer server.Close()
+	poller, announced := new_test_poller(t, server.URL)
+
+	poller.Poll()
+	server.set(rss_feed("a", "b", "c", "d"))
+	poller.Poll()
+	if got := ids(*announced); got != "c,d" {
+		t.Errorf("announced %s, want c,d oldest first", got)
+	}
+	poller.Poll()
+	if got := ids(*announced); got != "c,d" {
+		t.Errorf("announced %s after a poll without changes, want c,d", got)
+	}
+}
+
+func TestPollRemembersAcrossRestarts(t *testing.T) {
+	server := new_feed_server(rss_feed("a"))
+	defer server.Close()
+	state := filepath.Join(t.TempDir(), "news.json")
+	announced := []Item{}
+	announce := func(item Item) { announced = append(announced, item) }
+
+	NewPoller([]string{server.URL}, time.Hour, "test", state, announce).Poll()
+	server.set(rss_feed("a", "b"))
+	NewPoller([]string{server.URL}, time.Hour, "test", state, announce).Poll()
+	if got := ids(announced); got != "b" {
+		t.Errorf("announced %s after a restart, want b", got)
+	}
+}
+
+func TestPollFeedFailure(t *testing.T) {
+	good := new_feed_server(rss_feed("a"))
+	defer good.Close()
+	bad := new_feed_server("")
+	defer bad.Close()
+	poller, announced := new_test_poller(t, bad.URL, good.URL)
+
+	poller.Poll()
+	if got := ids(poller.Latest(10)); got != "a" {
+		t.Errorf("Latest = %s, want the working feed's a", got)
+	}
+	// The broken feed was never primed, so its items aren't announced when it comes back.
+	bad.set(rss_feed("x"))
+	good.set(rss_feed("a", "b"))
+	poller.Poll()
+	if got := ids(*announced); got != "b" {
+		t.Errorf("announced %s, want b", got)
+	}
+	// A failure in between doesn't make old items new again.
+	bad.set("")
+	poller.Poll()
+	bad.set(rss_feed("x", "y"))
+	poller.Poll()
+	if got := ids(*announced); got != "b,y" {
+		t.Errorf("announced %s, want b,y", got)
+	}
+}
+
+func TestLatestDoesNotWaitForFetches(t *testing.T) {
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(rss_feed("a")))
+	}))
+	defer slow.Close()
+	defer close(release)
+	poller, _ := new_test_poller(t, slow.URL)
+
+	go poller.Poll()
+	done := make(chan bool)
+	go func() {
+		poller.Latest(5)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Latest blocked while a feed was being fetched")
+	}
+}
+
+func TestStopWaitsForPoll(t *testing.T) {
+	requested := make(chan bool)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- true
+		<-release
+		w.Write([]byte(rss_feed("a")))
+	}))
+	defer server.Close()
+	poller, announced := new_test_poller(t, server.URL)
+	state := poller.seen.path
+	poller.Start()
+	<-requested
+
+	stopped := make(chan bool)
+	go func() {
+		poller.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while a poll was still fetching")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't return after the poll finished")
+	}
+	// The stopped poll gives up on what it fetched, the next poller starts from the file.
+	if len(*announced) != 0 {
+		t.Errorf("announced %s after Stop", ids(*announced))
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("the state file was written after Stop: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	irc "github.com/fluffle/goirc/client"
+	"strings"
+	"time"
+)
+
+const default_reclaim_interval = 60 // seconds
+
+// The nick we're using right now, which differs from the configured one while it's taken.
+func (zax *ZAX) current_nick() string {
+	if me := zax.IrcClient.Me(); me != nil {
+		return me.Nick
+	}
+	return zax.Config.Nickname
+}
+
+func (zax *ZAX) has_nick() bool {
+	return strings.EqualFold(zax.current_nick(), zax.Config.Nickname)
+}
+
+func (zax *ZAX) reclaim_interval() time.Duration {
+	interval := zax.Config.ReclaimInterval
+	if interval == 0 {
+		interval = default_reclaim_interval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// Try to get the configured nick back, through NickServ if it's set up to do so.
+func (zax *ZAX) reclaim_nick() {
+	if !zax.IrcClient.Connected() || zax.has_nick() {
+		return
+	}
+	nick := zax.Config.Nickname
+	ns := zax.Config.NickServ
+	recover := strings.ToUpper(ns.Recover)
+	log.Noticef("Trying to reclaim nick %s on %s (currently %s).", nick, zax.Name, zax.current_nick())
+	if recover != "" && ns.Password != "" {
+		zax.IrcClient.Privmsg(zax.nickserv(), fmt.Sprintf("%s %s %s", recover, nick, ns.Password))
+		if recover == "REGAIN" {
+			// REGAIN changes our nick as well.
+			return
+		}
+	}
+	zax.IrcClient.Nick(nick)
+}
+
+func (zax *ZAX) reclaim_loop() {
+	for !zax.is_quitting() {
+		time.Sleep(zax.reclaim_interval())
+		zax.reclaim_nick()
+	}
+}
+
+// Retries every ReclaimInterval seconds, and right away when whoever has our nick changes it or quits.
+func (zax *ZAX) setup_reclaim(c *irc.Conn) {
+	if zax.Config.ReclaimInterval < 0 {
+		return
+	}
+	c.HandleFunc(irc.CONNECTED,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if !zax.has_nick() {
+				// Give NickServ a moment to identify us first, GHOST and REGAIN need that.
+				time.AfterFunc(5*time.Second, zax.reclaim_nick)
+			}
+		}))
+	c.HandleFunc(irc.NICK,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if strings.EqualFold(line.Nick, zax.Config.Nickname) && !zax.has_nick() {
+				zax.reclaim_nick()
+			}
+		}))
+	c.HandleFunc(irc.QUIT,
+		locked(func(conn *irc.Conn, line *irc.Line) {
+			if strings.EqualFold(line.Nick, zax.Config.Nickname) && !zax.has_nick() {
+				zax.reclaim_nick()
+			}
+		}))
+	go zax.reclaim_loop()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"options"
+	"strconv"
+	"strings"
+)
+
+const default_options_file = "options.json"
+
+// Runtime options, changed with "%% opt" and kept across restarts.
+var opts *options.Store
+
+func (cfg *Config) options_file() string {
+	if cfg.OptionsFile == "" {
+		return default_options_file
+	}
+	return cfg.OptionsFile
+}
+
+// Defaults come from the config where there's a matching setting, so they follow a reload.
+func define_options() {
+	opts.Define("process_urls", options.Bool, strconv.FormatBool(config.ProcessUrls), "Look for links in messages and log them.")
+	opts.Define("reddit_lookup", options.Bool, "true", "Reply with the reddit thread for posted links.")
+	opts.Define("skip_repeats", options.Bool, strconv.FormatBool(reddit_settings.SkipRepeats), "Don't look up the same link twice in a row.")
+	opts.Define("report_relay", options.Bool, "true", "Copy messages to the report channel.")
+	opts.Define("command_prefix", options.String, ".", "What commands start with, e.g. \".\" for .g")
+	opts.Define("symbols", options.Bool, "true", "Run ?h, !nick, %% and << without the prefix.")
+	opts.Define("max_lines", options.Int, strconv.Itoa(config.Output.MaxLines), "Lines a command may reply with, 0 for no limit.")
+	opts.Define("search_seconds", options.Int, "3", "How long a history search may scan before giving up, 0 for no limit.")
+}
+
+// Scope of a channel in the options store, queries only see global values.
+func option_scope(zax *ZAX, channel string) string {
+	if !is_channel(channel) {
+		return ""
+	}
+	return zax.Name + "/" + channel
+}
+
+func format_setting(setting options.Setting) string {
+	value := setting.Value
+	if setting.Key.Kind == options.Bool {
+		if value == "true" {
+			value = "on"
+		} else {
+			value = "off"
+		}
+	}
+	if setting.Source == options.FromDefault {
+		return setting.Key.Name + "=" + value
+	}
+	return fmt.Sprintf("%s=%s (%s)", setting.Key.Name, value, setting.Source)
+}
+
+// %% opt [ list | get | set | unset ] [ #chan ] ...
+// "%% opt <name> [ <value> ]" from before the store existed still works, globally.
+func admin_opt(ctx *CommandContext, args []string) error {
+	verb := "list"
+	if len(args) > 0 {
+		switch args[0] {
+		case "list", "get", "set", "unset":
+			verb, args = args[0], args[1:]
+		default:
+			verb = "get"
+			if len(args) > 1 {
+				verb = "set"
+			}
+		}
+	}
+	scope := ""
+	if len(args) > 0 && (is_channel(args[0]) || strings.Contains(args[0], "/")) {
+		zax, channel, err := admin_target(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if !is_channel(channel) {
+			return fmt.Errorf("%s is not a channel", channel)
+		}
+		scope, args = option_scope(zax, channel), args[1:]
+	}
+	where := "globally"
+	if scope != "" {
+		where = "on " + scope
+	}
+
+	switch verb {
+	case "list":
+		list := []string{}
+		for _, setting := range opts.List(scope) {
+			list = append(list, format_setting(setting))
+		}
+		msg := "Options " + where + ": " + strings.Join(list, ", ")
+		if scope == "" {
+			if scopes := opts.Scopes(); len(scopes) > 0 {
+				msg += " -- overridden on " + strings.Join(scopes, ", ")
+			}
+		}
+		ctx.Reply(msg)
+	case "get":
+		if len(args) < 1 {
+			return errors.New("no option given")
+		}
+		setting, ok := opts.Lookup(args[0], scope)
+		if !ok {
+			return fmt.Errorf("no option called %s", args[0])
+		}
+		ctx.Reply(fmt.Sprintf("%s -- %s", format_setting(setting), setting.Key.Help))
+	case "set":
+		if len(args) < 2 {
+			return errors.New("syntax: %% opt set [ <#chan> ] <name> <value>")
+		}
+		if err := opts.Set(args[0], scope, strings.Join(args[1:], " ")); err != nil {
+			return err
+		}
+		setting, _ := opts.Lookup(args[0], scope)
+		ctx.Reply(fmt.Sprintf("Set %s %s.", format_setting(setting), where))
+	case "unset":
+		if len(args) < 1 {
+			return errors.New("no option given")
+		}
+		if !opts.Unset(args[0], scope) {
+			return fmt.Errorf("%s isn't set %s", args[0], where)
+		}
+		setting, _ := opts.Lookup(args[0], scope)
+		ctx.Reply(fmt.Sprintf("Unset %s %s, now %s.", args[0], where, format_setting(setting)))
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package options
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var log = logging.MustGetLogger("options")
+
+type Kind int
+
+const (
+	Bool Kind = iota
+	Int
+	String
+)
+
+func (kind Kind) String() string {
+	return []string{"bool", "int", "string"}[kind]
+}
+
+type Key struct {
+	Name    string
+	Kind    Kind
+	Default string
+	Help    string
+}
+
+// Where a value came from.
+const (
+	FromDefault = "default"
+	FromGlobal  = "global"
+	FromChannel = "channel"
+)
+
+type Setting struct {
+	Key    *Key
+	Value  string
+	Source string
+}
+
+// Typed runtime options with a global value and per-channel overrides, saved to a JSON
+// file on every change. Channels are scopes like "network/#chan", "" is the global scope.
+type Store struct {
+	lock     sync.Mutex
+	path     string
+	keys     map[string]*Key
+	Global   map[string]string
+	Channels map[string]map[string]string
+}
+
+func Load(path string) *Store {
+	store := &Store{path: path, keys: make(map[string]*Key)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to read %s: %s", path, err.Error())
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, store); err != nil {
+			log.Errorf("Unable to parse %s: %s", path, err.Error())
+		}
+	}
+	if store.Global == nil {
+		store.Global = make(map[string]string)
+	}
+	if store.Channels == nil {
+		store.Channels = make(map[string]map[string]string)
+	}
+	return store
+}
+
+func (store *Store) save() {
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	tmp := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Unable to write %s: %s", tmp, err.Error())
+		return
+	}
+	if err := os.Rename(tmp, store.path); err != nil {
+		log.Errorf("Unable to write %s: %s", store.path, err.Error())
+	}
+}
+
+// Register a key, or change its default if it exists already.
+func (store *Store) Define(name string, kind Kind, def, help string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.keys[name] = &Key{name, kind, def, help}
+}
+
+func (store *Store) Keys() []*Key {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	keys := []*Key{}
+	for _, key := range store.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+// Bring a value into its canonical form, so "yes" is stored as "true".
+func normalize(kind Kind, value string) (string, error) {
+	switch kind {
+	case Bool:
+		switch strings.ToLower(value) {
+		case "on", "true", "yes", "1":
+			return "true", nil
+		case "off", "false", "no", "0":
+			return "false", nil
+		}
+		return "", fmt.Errorf("'%s' is not on or off", value)
+	case Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("'%s' is not a number", value)
+		}
+		return strconv.Itoa(n), nil
+	}
+	return value, nil
+}
+
+func (store *Store) lookup(name, scope string) Setting {
+	key := store.keys[name]
+	if value, ok := store.Channels[strings.ToLower(scope)][name]; ok && scope != "" {
+		return Setting{key, value, FromChannel}
+	}
+	if value, ok := store.Global[name]; ok {
+		return Setting{key, value, FromGlobal}
+	}
+	return Setting{key, key.Default, FromDefault}
+}
+
+// The value of name in scope, falling back to the global value and then the default.
+func (store *Store) Lookup(name, scope string) (Setting, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.keys[name]; !ok {
+		return Setting{}, false
+	}
+	return store.lookup(name, scope), true
+}
+
+func (store *Store) Get(name, scope string) string {
+	setting, ok := store.Lookup(name, scope)
+	if !ok {
+		log.Errorf("Unknown option %s", name)
+	}
+	return setting.Value
+}
+
+func (store *Store) Bool(name, scope string) bool {
+	return store.Get(name, scope) == "true"
+}
+
+func (store *Store) Int(name, scope string) int {
+	n, _ := strconv.Atoi(store.Get(name, scope))
+	return n
+}
+
+// Set name for a channel, or globally if scope is empty.
+func (store *Store) Set(name, scope, value string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	key, ok := store.keys[name]
+	if !ok {
+		return fmt.Errorf("no option called %s", name)
+	}
+	value, err := normalize(key.Kind, value)
+	if err != nil {
+		return err
+	}
+	if scope == "" {
+		store.Global[name] = value
+	} else {
+		scope = strings.ToLower(scope)
+		if store.Channels[scope] == nil {
+			store.Channels[scope] = make(map[string]string)
+		}
+		store.Channels[scope][name] = value
+	}
+	store.save()
+	return nil
+}
+
+// Remove a global value or channel override, returns false if there was none.
+func (store *Store) Unset(name, scope string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	values := store.Global
+	if scope != "" {
+		scope = strings.ToLower(scope)
+		values = store.Channels[scope]
+	}
+	if _, ok := values[name]; !ok {
+		return false
+	}
+	delete(values, name)
+	if scope != "" && len(values) == 0 {
+		delete(store.Channels, scope)
+	}
+	store.save()
+	return true
+}
+
+// Every key with its value in scope.
+func (store *Store) List(scope string) []Setting {
+	keys := store.Keys()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	settings := []Setting{}
+	for _, key := range keys {
+		settings = append(settings, store.lookup(key.Name, scope))
+	}
+	return settings
+}
+
+// Channels that override anything.
+func (store *Store) Scopes() []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	scopes := []string{}
+	for scope := range store.Channels {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
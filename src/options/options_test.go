@@ -0,0 +1,117 @@
+package options
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func new_store(t *testing.T) (*Store, string) {
+	path := filepath.Join(t.TempDir(), "options.json")
+	store := Load(path)
+	store.Define("process_urls", Bool, "true", "")
+	store.Define("max_lines", Int, "0", "")
+	store.Define("command_prefix", String, ".", "")
+	return store, path
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		kind  Kind
+		value string
+		want  string
+		ok    bool
+	}{
+		{Bool, "on", "true", true},
+		{Bool, "YES", "true", true},
+		{Bool, "0", "false", true},
+		{Bool, "off", "false", true},
+		{Bool, "maybe", "", false},
+		{Int, "042", "42", true},
+		{Int, "-3", "-3", true},
+		{Int, "three", "", false},
+		{String, "!", "!", true},
+	}
+	for _, test := range tests {
+		got, err := normalize(test.kind, test.value)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("%s %q: got %q, %v, want %q", test.kind, test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestLookupFallsBack(t *testing.T) {
+	store, _ := new_store(t)
+	check := func(scope, value, source string) {
+		t.Helper()
+		setting, ok := store.Lookup("process_urls", scope)
+		if !ok || setting.Value != value || setting.Source != source {
+			t.Errorf("%q: got %s from %s, want %s from %s", scope, setting.Value, setting.Source, value, source)
+		}
+	}
+	check("net/#chan", "true", FromDefault)
+	if err := store.Set("process_urls", "", "off"); err != nil {
+		t.Fatal(err)
+	}
+	check("net/#chan", "false", FromGlobal)
+	if err := store.Set("process_urls", "net/#Chan", "on"); err != nil {
+		t.Fatal(err)
+	}
+	check("net/#chan", "true", FromChannel)
+	check("net/#other", "false", FromGlobal)
+	check("", "false", FromGlobal)
+
+	if !store.Unset("process_urls", "NET/#chan") {
+		t.Error("Unset didn't find the channel override")
+	}
+	check("net/#chan", "false", FromGlobal)
+	if store.Unset("process_urls", "net/#chan") {
+		t.Error("Unset removed an override twice")
+	}
+	if len(store.Scopes()) != 0 {
+		t.Errorf("scopes %v are left without overrides", store.Scopes())
+	}
+}
+
+func TestSetValidates(t *testing.T) {
+	store, _ := new_store(t)
+	if err := store.Set("nonsense", "", "1"); err == nil {
+		t.Error("set an unknown option")
+	}
+	if err := store.Set("max_lines", "", "lots"); err == nil {
+		t.Error("set an int to a word")
+	}
+	if store.Int("max_lines", "") != 0 {
+		t.Error("a rejected value was stored")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	store, path := new_store(t)
+	store.Set("max_lines", "", "5")
+	store.Set("command_prefix", "net/#chan", "!")
+
+	loaded := Load(path)
+	// Keys are defined by the program, only values are saved.
+	loaded.Define("max_lines", Int, "0", "")
+	loaded.Define("command_prefix", String, ".", "")
+	if n := loaded.Int("max_lines", "net/#chan"); n != 5 {
+		t.Errorf("max_lines = %d after loading, want 5", n)
+	}
+	if p := loaded.Get("command_prefix", "net/#chan"); p != "!" {
+		t.Errorf("command_prefix = %q after loading, want !", p)
+	}
+	if p := loaded.Get("command_prefix", "net/#other"); p != "." {
+		t.Errorf("command_prefix = %q in another channel, want the default", p)
+	}
+}
+
+func TestDefineChangesDefault(t *testing.T) {
+	store, _ := new_store(t)
+	store.Define("max_lines", Int, "3", "")
+	if n := store.Int("max_lines", ""); n != 3 {
+		t.Errorf("max_lines = %d, want the new default 3", n)
+	}
+	if len(store.List("")) != 3 {
+		t.Errorf("List has %d settings, want 3", len(store.List("")))
+	}
+}
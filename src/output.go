@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flood"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	irc_line_limit      = 512
+	default_host_length = 63 // Longest hostname servers allow, used until we know our own.
+	default_marker      = "…"
+)
+
+type OutputConfig struct {
+	ContinuationMarker string         // Appended to lines that continue on the next one.
+	MaxLines           int            // Lines a single command may send, 0 for no limit.
+	CommandLines       map[string]int // Per command limits, keyed by name, e.g. "m".
+}
+
+func (cfg *Config) continuation_marker() string {
+	if cfg.Output.ContinuationMarker == "" {
+		return default_marker
+	}
+	return cfg.Output.ContinuationMarker
+}
+
+// Line limit for a command, the command's own unless the config overrides it.
+// Otherwise the max_lines option, which defaults to Output.MaxLines.
+func (cfg *Config) max_lines(cmd Command, scope string) int {
+	if n, ok := cfg.Output.CommandLines[cmd.Name()]; ok {
+		return n
+	}
+	if limited, ok := cmd.(LimitedCommand); ok && limited.MaxLines() > 0 {
+		return limited.MaxLines()
+	}
+	return opts.Int("max_lines", scope)
+}
+
+// Bytes left for the text of a PRIVMSG to target once the server has added our prefix:
+// ":nick!ident@host PRIVMSG target :text\r\n"
+func (zax *ZAX) line_budget(target string) int {
+	nick, ident, host := zax.Config.Nickname, zax.IrcConfig.Me.Ident, ""
+	if me := zax.IrcClient.Me(); me != nil {
+		nick, ident, host = me.Nick, me.Ident, me.Host
+	}
+	host_length := len(host)
+	if host_length == 0 {
+		host_length = default_host_length
+	}
+	overhead := len(":") + len(nick) + len("!") + len(ident) + len("@") + host_length +
+		len(" PRIVMSG ") + len(target) + len(" :") + len("\r\n")
+	return irc_line_limit - overhead
+}
+
+func is_format_code(b byte) bool {
+	switch b {
+	case '\x02', '\x03', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		return true
+	}
+	return false
+}
+
+// Break text into runes and whole formatting codes, neither of which may be split.
+// Colour codes take up to two digits for the foreground and optionally ",bg".
+func split_atoms(text string) []string {
+	atoms := []string{}
+	for i := 0; i < len(text); {
+		if text[i] != '\x03' {
+			if is_format_code(text[i]) {
+				atoms = append(atoms, text[i:i+1])
+				i++
+				continue
+			}
+			_, size := utf8.DecodeRuneInString(text[i:])
+			atoms = append(atoms, text[i:i+size])
+			i += size
+			continue
+		}
+		j := i + 1
+		digits := func() {
+			for n := 0; n < 2 && j < len(text) && text[j] >= '0' && text[j] <= '9'; n++ {
+				j++
+			}
+		}
+		digits()
+		if j > i+1 && j+1 < len(text) && text[j] == ',' && text[j+1] >= '0' && text[j+1] <= '9' {
+			j++
+			digits()
+		}
+		atoms = append(atoms, text[i:j])
+		i = j
+	}
+	return atoms
+}
+
+// Formatting that is active at the end of a line, so the next one can pick it up again.
+type format_state struct {
+	toggles string // Toggle codes in the order they were switched on.
+	color   string
+}
+
+func (state *format_state) apply(atom string) {
+	switch {
+	case atom == "\x0f":
+		*state = format_state{}
+	case strings.HasPrefix(atom, "\x03"):
+		if len(atom) == 1 {
+			state.color = ""
+		} else {
+			state.color = atom
+		}
+	case len(atom) == 1 && is_format_code(atom[0]):
+		if strings.Contains(state.toggles, atom) {
+			state.toggles = strings.Replace(state.toggles, atom, "", 1)
+		} else {
+			state.toggles += atom
+		}
+	}
+}
+
+func (state *format_state) codes() string {
+	return state.toggles + state.color
+}
+
+func atoms_length(atoms []string) int {
+	n := 0
+	for _, atom := range atoms {
+		n += len(atom)
+	}
+	return n
+}
+
+// Split msg into lines of at most budget bytes, breaking at spaces where possible and
+// never inside a rune or formatting code. Lines that continue get marker appended and
+// formatting is carried over to the next line.
+func split_message(msg string, budget int, marker string) []string {
+	msg = strings.Replace(msg, "\r", "", -1)
+	lines := []string{}
+	for _, part := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		lines = append(lines, split_line(part, budget, marker)...)
+	}
+	return lines
+}
+
+func split_line(text string, budget int, marker string) []string {
+	lines := []string{}
+	atoms := split_atoms(text)
+	state := format_state{}
+	prefix := ""
+	for {
+		if len(prefix)+atoms_length(atoms) <= budget {
+			return append(lines, prefix+strings.Join(atoms, ""))
+		}
+		limit := budget - len(marker) - len(prefix)
+		n, size := 0, 0
+		for n < len(atoms) && size+len(atoms[n]) <= limit {
+			size += len(atoms[n])
+			n++
+		}
+		if n == 0 {
+			n = 1
+		}
+		line, rest := atoms[:n], atoms[n:]
+		for i := n; i > 0 && len(rest) > 0; i-- {
+			if i < len(atoms) && atoms[i] == " " {
+				line, rest = atoms[:i], atoms[i+1:]
+				break
+			}
+		}
+		lines = append(lines, prefix+strings.TrimRight(strings.Join(line, ""), " ")+marker)
+		for _, atom := range line {
+			state.apply(atom)
+		}
+		prefix = state.codes()
+		atoms = rest
+	}
+}
+
+// Keep at most max_lines lines if it's above 0, with the marker on the last one to show
+// there's more. That line is split again if the marker wouldn't fit in budget.
+func cut_lines(lines []string, max_lines, budget int, marker string) []string {
+	if max_lines <= 0 || len(lines) <= max_lines {
+		return lines
+	}
+	lines = lines[:max_lines]
+	last := lines[max_lines-1]
+	if !strings.HasSuffix(last, marker) {
+		lines[max_lines-1] = split_line(last, budget-len(marker), "")[0] + marker
+	}
+	return lines
+}
+
+// Split and queue a message, keeping at most max_lines lines if it's above 0.
+// Returns the number of lines queued.
+func (zax *ZAX) queue_lines(t, msg string, priority flood.Priority, max_lines int) int {
+	budget := zax.line_budget(t)
+	lines := split_message(msg, budget, config.continuation_marker())
+	if max_lines > 0 && len(lines) > max_lines {
+		log.Debugf("Cutting reply to %s from %d to %d lines.", t, len(lines), max_lines)
+	}
+	lines = cut_lines(lines, max_lines, budget, config.continuation_marker())
+	for _, line := range lines {
+		log.Debugf("Queue privmsg: [%s/%s] %s", zax.Name, t, line)
+		zax.queue.Push(t, line, priority)
+	}
+	return len(lines)
+}
+
+// Send a CTCP ACTION, split like any other message with every line wrapped on its own.
+// Keeps at most max_lines lines if it's above 0, returns the number of lines queued.
+func (zax *ZAX) Action(t, msg string, priority flood.Priority, max_lines int) int {
+	budget := zax.line_budget(t) - len("\x01ACTION \x01")
+	marker := config.continuation_marker()
+	lines := cut_lines(split_message(msg, budget, marker), max_lines, budget, marker)
+	for _, line := range lines {
+		zax.queue.Push(t, "\x01ACTION "+line+"\x01", priority)
+	}
+	return len(lines)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		budget int
+		want   []string
+	}{
+		{"fits", "hello world", 20, []string{"hello world"}},
+		{"exactly", "hello", 5, []string{"hello"}},
+		{"at spaces", "one two three four", 10, []string{"one two…", "three four"}},
+		{"long word", "abcdefghijklm", 6, []string{"abc…", "def…", "ghi…", "jklm"}},
+		{"newlines", "one\r\ntwo\n", 20, []string{"one", "two"}},
+		{"runes", "ääääää", 7, []string{"ää…", "ää…", "ää"}},
+		{"bold carried over", "\x02bold text here", 9, []string{"\x02bold…", "\x02text…", "\x02here"}},
+		{"bold switched off", "\x02a\x02 b c d e f", 8, []string{"\x02a\x02 b…", "c d e f"}},
+		{"colour carried over", "\x0304,12red words", 12, []string{"\x0304,12red…", "\x0304,12words"}},
+		{"reset", "\x02\x1dx\x0f yy zz", 8, []string{"\x02\x1dx\x0f…", "yy zz"}},
+	}
+	for _, test := range tests {
+		got := split_message(test.msg, test.budget, "…")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		for _, line := range got {
+			if len(line) > test.budget {
+				t.Errorf("%s: %q is longer than %d bytes", test.name, line, test.budget)
+			}
+			if !utf8.ValidString(line) {
+				t.Errorf("%s: %q splits a rune", test.name, line)
+			}
+		}
+	}
+}
+
+func TestSplitAtoms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"ab", []string{"a", "b"}},
+		{"ö", []string{"ö"}},
+		{"\x034x", []string{"\x034", "x"}},
+		{"\x03123", []string{"\x0312", "3"}},
+		{"\x0312,05x", []string{"\x0312,05", "x"}},
+		{"\x03,x", []string{"\x03", ",", "x"}},
+		{"\x0312,", []string{"\x0312", ","}},
+		{"\x02\x1f", []string{"\x02", "\x1f"}},
+	}
+	for _, test := range tests {
+		if got := split_atoms(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("split_atoms(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSplitLongText(t *testing.T) {
+	msg := strings.Repeat("word ", 1000)
+	lines := split_message(msg, 400, "…")
+	joined := strings.Replace(strings.Join(lines, " "), "…", "", -1)
+	if strings.Join(strings.Fields(joined), " ") != strings.TrimSpace(msg) {
+		t.Error("words were lost or changed while splitting")
+	}
+	for _, line := range lines {
+		if len(line) > 400 {
+			t.Fatalf("%d byte line", len(line))
+		}
+	}
+}
+
+func TestCutLines(t *testing.T) {
+	tests := []struct {
+		name      string
+		lines     []string
+		max_lines int
+		budget    int
+		want      []string
+	}{
+		{"unlimited", []string{"one", "two"}, 0, 10, []string{"one", "two"}},
+		{"fits", []string{"one", "two"}, 2, 10, []string{"one", "two"}},
+		{"marker added", []string{"one", "two", "three"}, 2, 10, []string{"one", "two…"}},
+		{"already marked", []string{"one…", "two…", "three"}, 2, 10, []string{"one…", "two…"}},
+		{"last line at the budget", []string{"aaaa bbbb", "cc"}, 1, 9, []string{"aaaa…"}},
+		{"long word at the budget", []string{"abcdefghi", "cc"}, 1, 9, []string{"abcdef…"}},
+		{"formatting", []string{"\x02bold text", "x"}, 1, 9, []string{"\x02bold…"}},
+	}
+	for _, test := range tests {
+		got := cut_lines(append([]string{}, test.lines...), test.max_lines, test.budget, "…")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		for _, line := range got {
+			if len(line) > test.budget {
+				t.Errorf("%s: %q is longer than %d bytes", test.name, line, test.budget)
+			}
+		}
+	}
+}
+
+func TestCommandLineLimit(t *testing.T) {
+	ctx := &CommandContext{MaxLines: 3, limited: true}
+	got := []int{}
+	queue := func(lines int) func(max_lines int) int {
+		return func(max_lines int) int {
+			got = append(got, max_lines)
+			if lines > max_lines {
+				return max_lines
+			}
+			return lines
+		}
+	}
+	// A reply, then an action, then a reply that no longer fits.
+	ctx.send("a", queue(1))
+	ctx.send("b", queue(5))
+	ctx.send("c", queue(1))
+	if !reflect.DeepEqual(got, []int{3, 2}) || ctx.MaxLines != 0 {
+		t.Errorf("queued with limits %v, %d lines left, want 3 then 2 and none left", got, ctx.MaxLines)
+	}
+}
@@ -0,0 +1,304 @@
+package query
+
+import (
+	"fmt"
+	"github.com/mvdan/xurls"
+	"history"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A history search: filters, plus the text to look for.
+//
+//	from:nick in:#chan net:name net:* since:3d before:2015-06-01 has:url
+//	words "a phrase" -exclude /regex/
+//
+// Words are matched literally, ignoring case. A /regex/, or --regex to make all of the
+// text one, is opt-in. --all is the same as net:*, --relevant sorts by relevance where
+// that's supported.
+type Query struct {
+	Filter      history.Filter // User, Channel, Network, Since and Before. Kind is up to the caller.
+	AllNetworks bool
+	Relevant    bool
+	HasUrl      bool
+	Text        string   // The words, phrases and exclusions as typed, for the message index.
+	Words       []string // Lower case, including phrases.
+	Exclude     []string
+	Regex       *regexp.Regexp
+}
+
+// Limits on user supplied regular expressions. Go's regexps run in linear time, but
+// big ones still take memory and time for every line they're run against.
+const (
+	max_regex_length = 200
+	max_regex_insts  = 1000 // Instructions in the compiled program, x{1000} is already too many.
+)
+
+// Compiles a user supplied regular expression, if it's within the limits.
+func Compile(expr string) (*regexp.Regexp, error) {
+	if len(expr) > max_regex_length {
+		return nil, fmt.Errorf("the expression is longer than %d characters", max_regex_length)
+	}
+	tree, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression: %s", strings.TrimPrefix(err.Error(), "error parsing regexp: "))
+	}
+	prog, err := syntax.Compile(tree.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression: %s", strings.TrimPrefix(err.Error(), "error parsing regexp: "))
+	}
+	if len(prog.Inst) > max_regex_insts {
+		return nil, fmt.Errorf("the expression is too complex, try fewer or smaller repeats")
+	}
+	return regexp.Compile(expr)
+}
+
+var filter_names = map[string]bool{"from": true, "in": true, "net": true, "since": true, "before": true, "has": true}
+
+var age_expr = regexp.MustCompile(`^(?:\d+[smhdwy])+$`)
+var age_part = regexp.MustCompile(`(\d+)([smhdwy])`)
+
+var age_units = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour,
+}
+
+var date_formats = []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02T15:04:05"}
+
+// An age like 3d or 1d12h, counted back from now, or a date in local time.
+func parse_time(value string, now time.Time) (int64, bool) {
+	if age_expr.MatchString(value) {
+		age := time.Duration(0)
+		for _, part := range age_part.FindAllStringSubmatch(value, -1) {
+			n, err := strconv.Atoi(part[1])
+			if err != nil {
+				return 0, false
+			}
+			age += time.Duration(n) * age_units[part[2]]
+		}
+		return now.Add(-age).Unix(), true
+	}
+	for _, format := range date_formats {
+		if t, err := time.ParseInLocation(format, value, now.Location()); err == nil {
+			return t.Unix(), true
+		}
+	}
+	return 0, false
+}
+
+// Splits on spaces, except inside "quotes" and /regexes/, which end at a slash followed
+// by a space or the end.
+func split(input string) ([]string, error) {
+	tokens := []string{}
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		start := i
+		if runes[i] == '-' && i+1 < len(runes) {
+			i++
+		}
+		switch runes[i] {
+		case '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("the phrase %s is missing its closing quote", string(runes[start:]))
+			}
+			i = end + 1
+		case '/':
+			end := i + 1
+			for end < len(runes) && !(runes[end] == '/' && (end+1 == len(runes) || unicode.IsSpace(runes[end+1]))) {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("the expression %s is missing its closing slash", string(runes[start:]))
+			}
+			i = end + 1
+		}
+		for i < len(runes) && !unicode.IsSpace(runes[i]) {
+			i++
+		}
+		tokens = append(tokens, string(runes[start:i]))
+	}
+	return tokens, nil
+}
+
+func is_channel(name string) bool {
+	return name != "" && strings.ContainsAny(name[:1], "#&+!")
+}
+
+// Filters are only recognised by their name with a value after it, anything else with
+// a colon is a word: "re: hi", "bob: hi", "foo:bar" or "http://...".
+func filter_name(token string) (string, string, bool) {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 || parts[1] == "" || !filter_names[strings.ToLower(parts[0])] {
+		return "", "", false
+	}
+	return strings.ToLower(parts[0]), parts[1], true
+}
+
+func Parse(input string, now time.Time) (*Query, error) {
+	tokens, err := split(input)
+	if err != nil {
+		return nil, err
+	}
+	q := &Query{}
+	text := []string{}
+	regex := ""
+	regex_mode := false
+	for _, token := range tokens {
+		switch token {
+		case "--all":
+			q.AllNetworks = true
+			continue
+		case "--relevant":
+			q.Relevant = true
+			continue
+		case "--regex":
+			regex_mode = true
+			continue
+		}
+		if name, value, ok := filter_name(strings.TrimPrefix(token, "-")); ok {
+			if strings.HasPrefix(token, "-") {
+				return nil, fmt.Errorf("filters can't be excluded, only words. Put it in quotes to search for \"%s\"", token[1:])
+			}
+			if err := q.set_filter(name, value, now); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(token) > 2 && strings.HasPrefix(token, "/") && strings.HasSuffix(token, "/") {
+			if regex != "" {
+				return nil, fmt.Errorf("only one /expression/ per search")
+			}
+			regex = token[1 : len(token)-1]
+			continue
+		}
+		text = append(text, token)
+		word := strings.ToLower(strings.Trim(strings.TrimPrefix(token, "-"), "\""))
+		if word == "" {
+			continue
+		}
+		if strings.HasPrefix(token, "-") {
+			q.Exclude = append(q.Exclude, word)
+		} else {
+			q.Words = append(q.Words, word)
+		}
+	}
+	q.Text = strings.Join(text, " ")
+	if regex_mode {
+		if regex != "" {
+			return nil, fmt.Errorf("use either --regex or a /expression/, not both")
+		}
+		regex, q.Text, q.Words, q.Exclude = q.Text, "", nil, nil
+		if regex == "" {
+			return nil, fmt.Errorf("--regex needs an expression")
+		}
+	}
+	if regex != "" {
+		if q.Regex, err = Compile(regex); err != nil {
+			return nil, err
+		}
+	}
+	if q.Filter.Since != 0 && q.Filter.Before != 0 && q.Filter.Since >= q.Filter.Before {
+		return nil, fmt.Errorf("since: has to be earlier than before:")
+	}
+	return q, nil
+}
+
+func (q *Query) set_filter(name, value string, now time.Time) error {
+	set := func(field *string) error {
+		if *field != "" {
+			return fmt.Errorf("%s: can only be given once", name)
+		}
+		*field = value
+		return nil
+	}
+	switch name {
+	case "from":
+		return set(&q.Filter.User)
+	case "in":
+		if !is_channel(value) {
+			return fmt.Errorf("in: takes a channel, like %s", example(name))
+		}
+		return set(&q.Filter.Channel)
+	case "net":
+		if value == "*" {
+			q.AllNetworks = true
+			return nil
+		}
+		return set(&q.Filter.Network)
+	case "since", "before":
+		t, ok := parse_time(value, now)
+		if !ok {
+			return fmt.Errorf("%s: takes an age or a date, like %s", name, example(name))
+		}
+		if name == "since" {
+			q.Filter.Since = t
+		} else {
+			q.Filter.Before = t
+		}
+		return nil
+	case "has":
+		if strings.ToLower(value) != "url" {
+			return fmt.Errorf("has: only knows has:url")
+		}
+		q.HasUrl = true
+		return nil
+	}
+	return fmt.Errorf("unknown filter %s:", name)
+}
+
+func example(name string) string {
+	switch name {
+	case "from":
+		return "from:nick"
+	case "in":
+		return "in:#chan"
+	case "net":
+		return "net:freenode or net:*"
+	case "since":
+		return "since:3d or since:2015-06-01"
+	case "before":
+		return "before:2015-06-01 or before:1w"
+	}
+	return "has:url"
+}
+
+func ContainsUrl(text string) bool {
+	return xurls.Relaxed.MatchString(text)
+}
+
+// Whether text has every word and none of the exclusions, ignoring case, and a url if
+// has:url was given. The regex is left to the caller, see MatchRegex.
+func (q *Query) Match(text string) bool {
+	lower := strings.ToLower(text)
+	for _, word := range q.Words {
+		if !strings.Contains(lower, word) {
+			return false
+		}
+	}
+	for _, word := range q.Exclude {
+		if strings.Contains(lower, word) {
+			return false
+		}
+	}
+	return !q.HasUrl || ContainsUrl(text)
+}
+
+func (q *Query) MatchRegex(text string) bool {
+	return q.Regex == nil || q.Regex.MatchString(text)
+}
@@ -0,0 +1,122 @@
+package query
+
+import (
+	"history"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input   string
+		filter  history.Filter
+		text    string
+		words   []string
+		exclude []string
+	}{
+		{"hello world", history.Filter{}, "hello world", []string{"hello", "world"}, nil},
+		{"re: hi", history.Filter{}, "re: hi", []string{"re:", "hi"}, nil},
+		{"bob: hi", history.Filter{}, "bob: hi", []string{"bob:", "hi"}, nil},
+		{"todo: fix", history.Filter{}, "todo: fix", []string{"todo:", "fix"}, nil},
+		{"foo:bar", history.Filter{}, "foo:bar", []string{"foo:bar"}, nil},
+		{"from:", history.Filter{}, "from:", []string{"from:"}, nil},
+		{"http://example.com/a", history.Filter{}, "http://example.com/a", []string{"http://example.com/a"}, nil},
+		{"from:Bob in:#Chan net:efnet hi", history.Filter{User: "Bob", Channel: "#Chan", Network: "efnet"}, "hi", []string{"hi"}, nil},
+		{"FROM:bob hi", history.Filter{User: "bob"}, "hi", []string{"hi"}, nil},
+		{`"A Phrase" -Spam -"two words"`, history.Filter{}, `"A Phrase" -Spam -"two words"`, []string{"a phrase"}, []string{"spam", "two words"}},
+		{"since:1d before:2h x", history.Filter{Since: now.Add(-24 * time.Hour).Unix(), Before: now.Add(-2 * time.Hour).Unix()}, "x", []string{"x"}, nil},
+		{"since:2016-03-01", history.Filter{Since: time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC).Unix()}, "", nil, nil},
+		{"since:1d12h", history.Filter{Since: now.Add(-36 * time.Hour).Unix()}, "", nil, nil},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.input, now)
+		if err != nil {
+			t.Errorf("%q: %s", test.input, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(q.Filter, test.filter) {
+			t.Errorf("%q: filter %+v, want %+v", test.input, q.Filter, test.filter)
+		}
+		if q.Text != test.text {
+			t.Errorf("%q: text %q, want %q", test.input, q.Text, test.text)
+		}
+		if !reflect.DeepEqual(q.Words, test.words) || !reflect.DeepEqual(q.Exclude, test.exclude) {
+			t.Errorf("%q: words %q and %q, want %q and %q", test.input, q.Words, q.Exclude, test.words, test.exclude)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	q, err := Parse("--all --relevant has:url net:* /fo+/ x", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.AllNetworks || !q.Relevant || !q.HasUrl || q.Regex == nil || q.Regex.String() != "fo+" || q.Text != "x" {
+		t.Errorf("got %+v", q)
+	}
+	q, err = Parse("--regex ^a b$", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Regex == nil || q.Regex.String() != "^a b$" || q.Text != "" || q.Words != nil {
+		t.Errorf("--regex: got %+v", q)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input   string
+		problem string
+	}{
+		{`"open`, "missing its closing quote"},
+		{"/open", "missing its closing slash"},
+		{"-from:bob", "filters can't be excluded"},
+		{"from:a from:b", "can only be given once"},
+		{"in:nochan", "in: takes a channel"},
+		{"since:soon", "since: takes an age or a date"},
+		{"has:image", "has: only knows has:url"},
+		{"since:1d before:2d", "since: has to be earlier than before:"},
+		{"/a/ /b/", "only one /expression/"},
+		{"--regex /a/ b", "either --regex or a /expression/"},
+		{"--regex", "--regex needs an expression"},
+		{"/(/", "invalid expression"},
+		{"/" + strings.Repeat("a", max_regex_length+1) + "/", "longer than"},
+		{"/a{999}b{999}/", "too complex"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.input, now)
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%q: got %v, want an error about %s", test.input, err, test.problem)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		input string
+		text  string
+		match bool
+	}{
+		{"hello", "Well HELLO there", true},
+		{"hello -there", "hello there", false},
+		{`"hello there"`, "oh hello there", true},
+		{`"hello there"`, "there hello", false},
+		{"re: hi", "re: hi all", true},
+		{"has:url", "see http://example.com/x", true},
+		{"has:url", "no link", false},
+		{"a.b", "axb", false},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.input, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.Match(test.text) && q.MatchRegex(test.text); got != test.match {
+			t.Errorf("%q on %q: %t, want %t", test.input, test.text, got, test.match)
+		}
+	}
+}
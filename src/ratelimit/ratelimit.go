@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// At most Count uses every Seconds seconds, no limit if either is 0.
+type Limit struct {
+	Count   int
+	Seconds int
+}
+
+func (limit Limit) Enabled() bool {
+	return limit.Count > 0 && limit.Seconds > 0
+}
+
+func (limit Limit) window() time.Duration {
+	return time.Duration(limit.Seconds) * time.Second
+}
+
+// A limit applied to everything sharing the same key, e.g. "user:net/host".
+type Rule struct {
+	Key   string
+	Limit Limit
+}
+
+// Sliding window limiter, remembers when each key was last used.
+type Limiter struct {
+	lock sync.Mutex
+	hits map[string][]time.Time
+}
+
+func New() *Limiter {
+	return &Limiter{hits: make(map[string][]time.Time)}
+}
+
+// Drop the hits that are out of the window, returns what's left.
+func (limiter *Limiter) recent(key string, limit Limit, now time.Time) []time.Time {
+	hits := limiter.hits[key]
+	cutoff := now.Add(-limit.window())
+	i := 0
+	for i < len(hits) && !hits[i].After(cutoff) {
+		i++
+	}
+	hits = hits[i:]
+	if len(hits) == 0 {
+		delete(limiter.hits, key)
+	} else {
+		limiter.hits[key] = hits
+	}
+	return hits
+}
+
+// How long until all the rules allow another use, 0 if they do now. Nothing is counted.
+func (limiter *Limiter) Wait(rules ...Rule) time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.wait(rules, time.Now())
+}
+
+func (limiter *Limiter) wait(rules []Rule, now time.Time) time.Duration {
+	wait := time.Duration(0)
+	for _, rule := range rules {
+		if !rule.Limit.Enabled() {
+			continue
+		}
+		hits := limiter.recent(rule.Key, rule.Limit, now)
+		if len(hits) < rule.Limit.Count {
+			continue
+		}
+		free := hits[len(hits)-rule.Limit.Count].Add(rule.Limit.window()).Sub(now)
+		if free > wait {
+			wait = free
+		}
+	}
+	return wait
+}
+
+// Check every rule and count a use for all of them if none is exhausted.
+// Otherwise nothing is counted and the time until the longest blocked rule frees up is returned.
+func (limiter *Limiter) Allow(rules ...Rule) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	if wait := limiter.wait(rules, now); wait > 0 {
+		return false, wait
+	}
+	for _, rule := range rules {
+		if rule.Limit.Enabled() {
+			limiter.hits[rule.Key] = append(limiter.hits[rule.Key], now)
+		}
+	}
+	return true, 0
+}
+
+// Forget everything, e.g. after the limits changed.
+func (limiter *Limiter) Reset() {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.hits = make(map[string][]time.Time)
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	limiter := New()
+	two := Limit{2, 60}
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow(Rule{"user:a", two}); !ok {
+			t.Fatalf("use %d of 2 was refused", i+1)
+		}
+	}
+	ok, wait := limiter.Allow(Rule{"user:a", two})
+	if ok {
+		t.Fatal("a third use was allowed")
+	}
+	if wait <= 59*time.Second || wait > 60*time.Second {
+		t.Errorf("wait %s, want just under a minute", wait)
+	}
+	if ok, _ := limiter.Allow(Rule{"user:b", two}); !ok {
+		t.Error("another key was refused")
+	}
+}
+
+func TestDisabledLimits(t *testing.T) {
+	limiter := New()
+	for _, limit := range []Limit{{0, 60}, {5, 0}, {}} {
+		for i := 0; i < 10; i++ {
+			if ok, _ := limiter.Allow(Rule{"key", limit}); !ok {
+				t.Fatalf("%+v refused a use", limit)
+			}
+		}
+	}
+	if len(limiter.hits) != 0 {
+		t.Errorf("disabled limits were counted: %v", limiter.hits)
+	}
+}
+
+func TestAllowCountsAllOrNothing(t *testing.T) {
+	limiter := New()
+	user := Rule{"user:a", Limit{1, 60}}
+	channel := Rule{"channel:#c", Limit{3, 60}}
+	if ok, _ := limiter.Allow(user, channel); !ok {
+		t.Fatal("the first use was refused")
+	}
+	if ok, _ := limiter.Allow(user, channel); ok {
+		t.Fatal("the user limit didn't apply")
+	}
+	// The refused use didn't count against the channel.
+	if n := len(limiter.hits[channel.Key]); n != 1 {
+		t.Errorf("the channel has %d uses, want 1", n)
+	}
+	limiter.Allow(Rule{"user:b", Limit{1, 60}}, channel)
+	limiter.Allow(Rule{"user:c", Limit{1, 60}}, channel)
+	if ok, _ := limiter.Allow(Rule{"user:d", Limit{1, 60}}, channel); ok {
+		t.Error("the channel limit didn't apply")
+	}
+}
+
+func TestWindowSlides(t *testing.T) {
+	limiter := New()
+	limit := Limit{2, 10}
+	now := time.Now()
+	limiter.hits["key"] = []time.Time{now.Add(-11 * time.Second), now.Add(-5 * time.Second)}
+	ok, _ := limiter.Allow(Rule{"key", limit})
+	if !ok {
+		t.Fatal("a use outside the window still counted")
+	}
+	ok, wait := limiter.Allow(Rule{"key", limit})
+	if ok {
+		t.Fatal("a third use within the window was allowed")
+	}
+	if wait <= 4*time.Second || wait > 5*time.Second {
+		t.Errorf("wait %s, want about 5s until the oldest use leaves the window", wait)
+	}
+}
+
+func TestReset(t *testing.T) {
+	limiter := New()
+	rule := Rule{"key", Limit{1, 60}}
+	limiter.Allow(rule)
+	limiter.Reset()
+	if ok, _ := limiter.Allow(rule); !ok {
+		t.Error("refused after Reset")
+	}
+}
+
+func TestWait(t *testing.T) {
+	limiter := New()
+	rule := Rule{"login:host", Limit{2, 60}}
+	for i := 0; i < 5; i++ {
+		if wait := limiter.Wait(rule); wait != 0 {
+			t.Fatalf("Wait %s before any use", wait)
+		}
+	}
+	limiter.Allow(rule)
+	limiter.Allow(rule)
+	if wait := limiter.Wait(rule); wait <= 59*time.Second || wait > 60*time.Second {
+		t.Errorf("Wait %s, want just under a minute", wait)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"flood"
+	irc "github.com/fluffle/goirc/client"
+	records "history"
+	"sort"
+	"strings"
+)
+
+// Everything a command handler needs to know about the line that triggered it.
+type CommandContext struct {
+	Zax        *ZAX // Network the command came from.
+	Conn       *irc.Conn
+	Line       *irc.Line
+	Sender     string
+	SenderHost string
+	Channel    string
+	ReplyTo    string
+	Text       string
+	Args       []string        // Args[0] is the command name, or the symbol it was run with.
+	Prefix     string          // Command prefix in the channel, for help texts.
+	Account    string          // Services account of the sender, if known.
+	Logged     *records.Record // The line as it went into the history, nil if it didn't.
+	Role       Role            // Filled in by Dispatch.
+	Err        error           // Set by commands that failed, for the audit log.
+	Priority   flood.Priority
+	MaxLines   int // Lines the command may still send, no limit if 0.
+	limited    bool
+}
+
+func (ctx *CommandContext) Reply(msg string) {
+	ctx.send(msg, func(max_lines int) int {
+		return ctx.Zax.queue_lines(ctx.ReplyTo, msg, ctx.Priority, max_lines)
+	})
+}
+
+// An action to any target on any network, counted against the command's lines like a reply.
+func (ctx *CommandContext) Act(zax *ZAX, target, msg string) {
+	ctx.send(msg, func(max_lines int) int {
+		return zax.Action(target, msg, ctx.Priority, max_lines)
+	})
+}
+
+// A message to any target on any network, counted against the command's lines like a reply.
+func (ctx *CommandContext) Say(zax *ZAX, target, msg string) {
+	ctx.send(msg, func(max_lines int) int {
+		return zax.queue_lines(target, msg, ctx.Priority, max_lines)
+	})
+}
+
+func (ctx *CommandContext) send(msg string, queue func(max_lines int) int) {
+	if ctx.limited && ctx.MaxLines <= 0 {
+		log.Debugf("Line limit reached, not sending: %s", msg)
+		return
+	}
+	sent := queue(ctx.MaxLines)
+	if ctx.limited {
+		ctx.MaxLines -= sent
+	}
+}
+
+type CommandFunc func(ctx *CommandContext)
+
+type Command interface {
+	Name() string
+	Aliases() []string
+	Usage() string
+	Role() Role // Minimum role needed to run the command.
+	Run(ctx *CommandContext)
+}
+
+// Commands that can also be run with a symbol instead of prefix + name, e.g. "?h".
+// Attached symbols take their argument glued on, e.g. "!nick".
+type SymbolCommand interface {
+	Command
+	Symbol() string
+	Attached() bool
+}
+
+// Commands that cap how many lines one invocation may send.
+type LimitedCommand interface {
+	Command
+	MaxLines() int
+}
+
+// Commands that query other sites, these share the Cooldown.Remote budget.
+type RemoteCommand interface {
+	Command
+	QueriesRemote() bool
+}
+
+// Commands with extra help pages, e.g. "?h s symbols".
+type TopicCommand interface {
+	Command
+	Topic(name string) (string, bool)
+}
+
+// Generic Command implementation used by all the built-in commands.
+type SimpleCommand struct {
+	Trigger string // Name without the prefix, e.g. "g".
+	Alias   []string
+	Special string // Symbol that works without the prefix, e.g. "?h".
+	Help    string // {p} is replaced with the prefix.
+	Topics  map[string]string
+	MinRole Role
+	Glued   bool // The argument is glued to the symbol.
+	Lines   int  // Max lines per invocation, unlimited if 0.
+	Remote  bool // Queries another site.
+	Func    CommandFunc
+}
+
+func (cmd *SimpleCommand) Name() string            { return cmd.Trigger }
+func (cmd *SimpleCommand) Aliases() []string       { return cmd.Alias }
+func (cmd *SimpleCommand) Usage() string           { return cmd.Help }
+func (cmd *SimpleCommand) Role() Role              { return cmd.MinRole }
+func (cmd *SimpleCommand) Symbol() string          { return cmd.Special }
+func (cmd *SimpleCommand) Attached() bool          { return cmd.Glued }
+func (cmd *SimpleCommand) MaxLines() int           { return cmd.Lines }
+func (cmd *SimpleCommand) QueriesRemote() bool     { return cmd.Remote }
+func (cmd *SimpleCommand) Run(ctx *CommandContext) { cmd.Func(ctx) }
+
+func (cmd *SimpleCommand) Topic(name string) (string, bool) {
+	text, ok := cmd.Topics[name]
+	return text, ok
+}
+
+type CommandRegistry struct {
+	commands []Command
+	lookup   map[string]Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{[]Command{}, make(map[string]Command)}
+}
+
+func (registry *CommandRegistry) Register(cmd Command) {
+	tokens := append([]string{cmd.Name()}, cmd.Aliases()...)
+	for _, token := range tokens {
+		if _, exists := registry.lookup[token]; exists {
+			log.Warningf("Command token '%s' registered twice, ignoring the one from '%s'.", token, cmd.Name())
+			continue
+		}
+		registry.lookup[token] = cmd
+	}
+	registry.commands = append(registry.commands, cmd)
+}
+
+func (registry *CommandRegistry) Commands() []Command {
+	return registry.commands
+}
+
+func (registry *CommandRegistry) Find(name string) Command {
+	return registry.lookup[name]
+}
+
+// The command run with a symbol, e.g. "?h", or "!nick" for attached ones.
+func (registry *CommandRegistry) FindSymbol(token string) Command {
+	for _, cmd := range registry.commands {
+		sym, ok := cmd.(SymbolCommand)
+		if !ok || sym.Symbol() == "" {
+			continue
+		}
+		if token == sym.Symbol() || (sym.Attached() && strings.HasPrefix(token, sym.Symbol())) {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// "zax:" or "zax," addresses the bot.
+func addresses(token, nick string) bool {
+	if !strings.HasSuffix(token, ":") && !strings.HasSuffix(token, ",") {
+		return false
+	}
+	return strings.EqualFold(token[:len(token)-1], nick)
+}
+
+// Work out which command a line is for. Commands are the prefix followed by their name,
+// or just the name when the bot is addressed by nick ("zax: s find portal") or in a query.
+// Symbols work without the prefix, unless the symbols option is off in the channel.
+// Returns the arguments with the nick and prefix taken off.
+func (registry *CommandRegistry) Resolve(ctx *CommandContext) (Command, []string) {
+	args := ctx.Args
+	scope := option_scope(ctx.Zax, ctx.Channel)
+	direct := !is_channel(ctx.Channel)
+	if len(args) > 1 && addresses(args[0], ctx.Zax.current_nick()) {
+		args = args[1:]
+		direct = true
+	}
+	if len(args) == 0 || args[0] == "" {
+		return nil, nil
+	}
+	token := args[0]
+	name := strings.TrimPrefix(token, ctx.Prefix)
+	if (name != token || direct || ctx.Prefix == "") && name != "" {
+		if cmd := registry.Find(name); cmd != nil {
+			return cmd, append([]string{name}, args[1:]...)
+		}
+	}
+	if opts.Bool("symbols", scope) || direct {
+		if cmd := registry.FindSymbol(token); cmd != nil {
+			return cmd, args
+		}
+	}
+	return nil, nil
+}
+
+// Run the command the line is for, returns false if there is none.
+func (registry *CommandRegistry) Dispatch(ctx *CommandContext) bool {
+	ctx.Prefix = opts.Get("command_prefix", option_scope(ctx.Zax, ctx.Channel))
+	cmd, args := registry.Resolve(ctx)
+	if cmd == nil {
+		return false
+	}
+	ctx.Args = args
+	ctx.Text = strings.Join(args, " ")
+	ctx.Role = user_role(ctx)
+	// Cooldowns come first so denied attempts can't flood the audit log.
+	if !check_cooldown(ctx, cmd) {
+		return true
+	}
+	if cmd.Role() > ctx.Role {
+		log.Debugf("%s (%s) needs role %s for %s.", ctx.Sender, ctx.SenderHost, cmd.Role(), cmd.Name())
+		if cmd.Role() >= RoleAdmin {
+			record_audit(ctx, "denied")
+		}
+		return true
+	}
+	if cmd.Role() >= RoleAdmin {
+		ctx.Priority = flood.High
+	}
+	if max_lines := config.max_lines(cmd, option_scope(ctx.Zax, ctx.Channel)); max_lines > 0 {
+		ctx.MaxLines = max_lines
+		ctx.limited = true
+	}
+	log.Debugf("Executing command %s.", cmd.Name())
+	cmd.Run(ctx)
+	if cmd.Role() >= RoleAdmin {
+		outcome := "ok"
+		if ctx.Err != nil {
+			outcome = ctx.Err.Error()
+		}
+		record_audit(ctx, outcome)
+	}
+	return true
+}
+
+// Short form of a command for the help listing, "g" + "game" becomes ".g(ame)".
+func command_label(cmd Command, prefix string) string {
+	name := prefix + cmd.Name()
+	aliases := append([]string{}, cmd.Aliases()...)
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		if len(alias) > len(cmd.Name()) && strings.HasPrefix(alias, cmd.Name()) {
+			return name + "(" + strings.TrimPrefix(alias, cmd.Name()) + ")"
+		}
+	}
+	return name
+}
+
+func (registry *CommandRegistry) HelpSummary(role Role, prefix string) string {
+	labels := []string{}
+	for _, cmd := range registry.commands {
+		if cmd.Role() > role {
+			continue
+		}
+		label := command_label(cmd, prefix)
+		if sym, ok := cmd.(SymbolCommand); ok && sym.Symbol() != "" {
+			label += "/" + sym.Symbol()
+		}
+		labels = append(labels, label)
+	}
+	return "Cmds: [[" + strings.Join(labels, " ") + "]] -- Type " + prefix + "help <cmd> for more info."
+}
+
+func (registry *CommandRegistry) HelpFor(args []string, prefix string) string {
+	cmd := registry.Find(strings.TrimPrefix(args[0], prefix))
+	if cmd == nil {
+		cmd = registry.FindSymbol(args[0])
+	}
+	if cmd == nil {
+		return ""
+	}
+	if len(args) > 1 {
+		if topics, ok := cmd.(TopicCommand); ok {
+			if text, found := topics.Topic(args[1]); found {
+				return strings.Replace(text, "{p}", prefix, -1)
+			}
+		}
+	}
+	return strings.Replace(cmd.Usage(), "{p}", prefix, -1)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"options"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+	opts = options.Load(filepath.Join(t.TempDir(), "options.json"))
+	define_options()
+	if err := opts.Set("command_prefix", "net/#bang", "!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.Set("symbols", "net/#quiet", "off"); err != nil {
+		t.Fatal(err)
+	}
+	zax, _ := test_network("net")
+	defer zax.queue.Stop()
+
+	registry := NewCommandRegistry()
+	registry.Register(&SimpleCommand{Trigger: "s", Alias: []string{"steam"}})
+	registry.Register(&SimpleCommand{Trigger: "help", Special: "?h"})
+	registry.Register(&SimpleCommand{Trigger: "seen", Special: "!", Glued: true})
+
+	tests := []struct {
+		channel, text string
+		want          string // Name of the command, "" for none.
+		args          string
+	}{
+		{"#chan", ".s find portal", "s", "s find portal"},
+		{"#chan", ".steam find", "s", "steam find"},
+		{"#chan", "s find portal", "", ""},
+		{"#chan", ".simple", "", ""},
+		{"#chan", ".sfind", "", ""},
+		{"#chan", ".", "", ""},
+		{"#chan", "", "", ""},
+		{"#chan", "?h s", "help", "?h s"},
+		{"#chan", "!bob", "seen", "!bob"},
+		{"#chan", "I said ?h", "", ""},
+
+		// Per-channel prefix.
+		{"#bang", "!s find", "s", "s find"},
+		{"#bang", ".s find", "", ""},
+		{"#BANG", "!s find", "s", "s find"},
+
+		// Addressed by nick, the prefix is optional.
+		{"#chan", "zax: s find portal", "s", "s find portal"},
+		{"#chan", "ZAX, .s find", "s", "s find"},
+		{"#chan", "zax: ?h", "help", "?h"},
+		{"#chan", "zax:", "", ""},
+		{"#chan", "zaxx: s find", "", ""},
+		{"#chan", "zax s find", "", ""},
+
+		// In a query, the prefix is optional.
+		{"bob", "s find portal", "s", "s find portal"},
+		{"bob", ".s find portal", "s", "s find portal"},
+		{"bob", "simple", "", ""},
+		{"bob", "?h", "help", "?h"},
+
+		// Symbols switched off, but still there when addressed or in a query.
+		{"#quiet", "?h", "", ""},
+		{"#quiet", "!bob", "", ""},
+		{"#quiet", ".s find", "s", "s find"},
+		{"#quiet", "zax: ?h", "help", "?h"},
+	}
+	for _, test := range tests {
+		ctx := &CommandContext{Zax: zax, Channel: test.channel, Args: strings.Split(test.text, " ")}
+		ctx.Prefix = opts.Get("command_prefix", option_scope(zax, test.channel))
+		cmd, args := registry.Resolve(ctx)
+		name := ""
+		if cmd != nil {
+			name = cmd.Name()
+		}
+		if name != test.want {
+			t.Errorf("%s %q: got command %q, want %q", test.channel, test.text, name, test.want)
+		}
+		if cmd != nil && strings.Join(args, " ") != test.args {
+			t.Errorf("%s %q: got args %q, want %q", test.channel, test.text, args, test.args)
+		}
+	}
+}
+
+func TestFindSymbol(t *testing.T) {
+	registry := NewCommandRegistry()
+	registry.Register(&SimpleCommand{Trigger: "help", Special: "?h"})
+	registry.Register(&SimpleCommand{Trigger: "seen", Special: "!", Glued: true})
+	registry.Register(&SimpleCommand{Trigger: "g"})
+	tests := map[string]string{"?h": "help", "?hs": "", "!bob": "seen", "!": "seen", "g": "", "": ""}
+	for token, want := range tests {
+		name := ""
+		if cmd := registry.FindSymbol(token); cmd != nil {
+			name = cmd.Name()
+		}
+		if name != want {
+			t.Errorf("FindSymbol(%q) = %q, want %q", token, name, want)
+		}
+	}
+}
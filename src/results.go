@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	records "history"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	result_limit     = 1000 // Results kept for next/prev, the count goes beyond it.
+	result_timeout   = 30 * time.Minute
+	context_lines    = 2 // Lines before and after a match that "context" shows.
+	max_context_line = 5
+)
+
+// The results of someone's last history search in a channel, for next, prev and context.
+type ResultSet struct {
+	Records     []records.Record // Newest or best first, at most result_limit of them.
+	Total       int
+	Pos         int // The one shown last.
+	WithNetwork bool
+	Expires     time.Time
+}
+
+type ResultSets struct {
+	lock sync.Mutex
+	sets map[string]*ResultSet // By network/channel/nick, see result_key.
+}
+
+var results = ResultSets{sets: make(map[string]*ResultSet)}
+
+func result_key(ctx *CommandContext) string {
+	return strings.ToLower(ctx.Zax.Name + "/" + ctx.Channel + "/" + ctx.Sender)
+}
+
+func (sets *ResultSets) put(key string, set *ResultSet) {
+	sets.lock.Lock()
+	defer sets.lock.Unlock()
+	now := time.Now()
+	for k, old := range sets.sets {
+		if now.After(old.Expires) {
+			delete(sets.sets, k)
+		}
+	}
+	set.Expires = now.Add(result_timeout)
+	sets.sets[key] = set
+}
+
+// Moves through the results by delta and returns the record there, with its position.
+func (sets *ResultSets) step(key string, delta int) (records.Record, string, error) {
+	sets.lock.Lock()
+	defer sets.lock.Unlock()
+	set, ok := sets.sets[key]
+	if !ok || time.Now().After(set.Expires) {
+		return records.Record{}, "", errors.New("Search for something first.")
+	}
+	pos := set.Pos + delta
+	switch {
+	case pos < 0:
+		return records.Record{}, "", errors.New("That was the first one.")
+	case pos >= set.Total:
+		return records.Record{}, "", errors.New("No more results.")
+	case pos >= len(set.Records):
+		return records.Record{}, "", fmt.Errorf("That's all %d I kept, narrow the search down to see the rest.", len(set.Records))
+	}
+	set.Pos = pos
+	set.Expires = time.Now().Add(result_timeout)
+	return set.Records[pos], fmt.Sprintf("[%d/%d] %s", pos+1, set.Total, format_record(set.Records[pos], set.WithNetwork)), nil
+}
+
+// Keeps the results for next and prev, and shows the first one.
+func show_results(ctx *CommandContext, set *ResultSet) {
+	key := result_key(ctx)
+	results.put(key, set)
+	_, line, err := results.step(key, 0)
+	if err != nil {
+		ctx.Reply("Nothing found.")
+		return
+	}
+	ctx.Reply(line)
+}
+
+func cmd_next(ctx *CommandContext) {
+	step_results(ctx, 1)
+}
+
+func cmd_prev(ctx *CommandContext) {
+	step_results(ctx, -1)
+}
+
+func step_results(ctx *CommandContext, delta int) {
+	_, line, err := results.step(result_key(ctx), delta)
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	ctx.Reply(line)
+}
+
+// context [ <lines> ]: the messages around the result shown last, from the channel it was in.
+func cmd_context(ctx *CommandContext) {
+	n := context_lines
+	if len(ctx.Args) > 1 {
+		lines, err := strconv.Atoi(ctx.Args[1])
+		if err != nil || lines < 1 || lines > max_context_line {
+			ctx.Reply(fmt.Sprintf("Syntax: %scontext [ <lines> ] -- 1 to %d lines before and after.", ctx.Prefix, max_context_line))
+			return
+		}
+		n = lines
+	}
+	record, _, err := results.step(result_key(ctx), 0)
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	if !is_channel(record.Channel) {
+		ctx.Reply("That wasn't said in a channel, there's no context.")
+		return
+	}
+	timeline, match, err := history_context(record, n)
+	if err != nil {
+		log.Errorf("History query failed: %s", err.Error())
+		return
+	}
+	for i, line := range timeline {
+		text := format_record(line, false)
+		if i == match {
+			text = "> " + text
+		}
+		ctx.Reply(text)
+	}
+}
+
+// Up to n messages before and after record in its channel. Returns them in order with
+// the index of record among them.
+func history_context(record records.Record, n int) ([]records.Record, int, error) {
+	filter := records.Filter{Kind: records.KindMessage, Network: record.Network, Channel: record.Channel, Before: record.Time}
+	before, err := history.store.Search(filter, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Messages from the same second are all in after, the match among them.
+	filter.Before, filter.Since, filter.Oldest = 0, record.Time, true
+	after, err := history.store.Search(filter, 2*n+10)
+	if err != nil {
+		return nil, 0, err
+	}
+	timeline := []records.Record{}
+	for i := len(before) - 1; i >= 0; i-- {
+		timeline = append(timeline, before[i])
+	}
+	match := -1
+	for i, line := range after {
+		same := line.Text == record.Text || record.Kind == records.KindUrl && strings.Contains(line.Text, record.Text)
+		if match < 0 && line.Time == record.Time && line.User == record.User && same {
+			match = len(timeline) + i
+		}
+	}
+	timeline = append(timeline, after...)
+	if match < 0 {
+		// Events aren't messages, put them where they happened.
+		match = len(before)
+		timeline = append(timeline[:match], append([]records.Record{record}, timeline[match:]...)...)
+	}
+	start, end := match-n, match+n+1
+	if start < 0 {
+		start = 0
+	}
+	if end > len(timeline) {
+		end = len(timeline)
+	}
+	return timeline[start:end], match - start, nil
+}
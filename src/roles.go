@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"ignore"
+	"regexp"
+	"strings"
+)
+
+// What a user is allowed to do, every command needs one of these.
+type Role int
+
+const (
+	RoleUser Role = iota
+	RoleTrusted
+	RoleAdmin
+	RoleOwner
+)
+
+var role_names = []string{"user", "trusted", "admin", "owner"}
+
+func (role Role) String() string {
+	return role_names[role]
+}
+
+func parse_role(name string) (Role, bool) {
+	for i, role_name := range role_names {
+		if strings.EqualFold(name, role_name) {
+			return Role(i), true
+		}
+	}
+	return RoleUser, false
+}
+
+type RoleConfig struct {
+	Role      string   // owner, admin or trusted.
+	Hostmasks []string // nick!user@host patterns with * and ?, or a /regex/.
+	Accounts  []string // Services accounts, needs account-notify/extended-join or account-tag on the server.
+	Channels  []string // "#chan" or "network/#chan" the role is limited to, everywhere if empty.
+}
+
+// Compiled form of a RoleConfig, or of the old Config.Admin rule.
+type RoleGrant struct {
+	Role     Role
+	masks    []*regexp.Regexp
+	accounts []string
+	channels []string
+	legacy   *AdminRule
+}
+
+var role_grants []*RoleGrant
+
+func compile_role(rc RoleConfig) (*RoleGrant, error) {
+	role, ok := parse_role(rc.Role)
+	if !ok {
+		return nil, fmt.Errorf("unknown role '%s', use one of %s", rc.Role, strings.Join(role_names, ", "))
+	}
+	if len(rc.Hostmasks) == 0 && len(rc.Accounts) == 0 {
+		return nil, fmt.Errorf("role %s has no Hostmasks or Accounts", rc.Role)
+	}
+	grant := &RoleGrant{Role: role, accounts: rc.Accounts, channels: rc.Channels}
+	for _, mask := range rc.Hostmasks {
+		if !strings.HasPrefix(mask, "/") && !(strings.Contains(mask, "!") && strings.Contains(mask, "@")) {
+			return nil, fmt.Errorf("role %s: '%s' is not a full nick!user@host mask", rc.Role, mask)
+		}
+		expr, err := ignore.Compile(mask)
+		if err != nil {
+			return nil, fmt.Errorf("role %s: invalid mask '%s': %s", rc.Role, mask, err.Error())
+		}
+		grant.masks = append(grant.masks, expr)
+	}
+	for _, ch := range rc.Channels {
+		name := ch[strings.Index(ch, "/")+1:]
+		if name == "" || !strings.ContainsAny(name[:1], "#&+!") {
+			return nil, fmt.Errorf("role %s: '%s' is not a channel name", rc.Role, ch)
+		}
+	}
+	return grant, nil
+}
+
+// Config.Admin is still honoured, as an admin everywhere.
+func compile_roles(cfg *Config) ([]*RoleGrant, error) {
+	grants := []*RoleGrant{}
+	rule, err := parse_admin_rule(cfg.Admin)
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil {
+		if rule.Field == "nick" {
+			log.Warning("Admin matches on nick, which anyone can take. Consider Roles with a hostmask or account instead.")
+		}
+		grants = append(grants, &RoleGrant{Role: RoleAdmin, legacy: rule})
+	}
+	for _, rc := range cfg.Roles {
+		grant, err := compile_role(rc)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// Whether a "#chan" or "network/#chan" list includes channel.
+func channel_listed(list []string, network, channel string) bool {
+	for _, ch := range list {
+		if strings.EqualFold(ch, channel) || strings.EqualFold(ch, network+"/"+channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (grant *RoleGrant) matches(ctx *CommandContext) bool {
+	if len(grant.channels) > 0 && !channel_listed(grant.channels, ctx.Zax.Name, ctx.Channel) {
+		return false
+	}
+	if grant.legacy != nil {
+		if grant.legacy.Field == "host" {
+			return grant.legacy.Expr.MatchString(ctx.SenderHost)
+		}
+		return grant.legacy.Expr.MatchString(ctx.Sender)
+	}
+	hostmask := ctx.Sender + "!" + ctx.Line.Ident + "@" + ctx.SenderHost
+	for _, expr := range grant.masks {
+		if expr.MatchString(hostmask) {
+			return true
+		}
+	}
+	if ctx.Account != "" {
+		for _, account := range grant.accounts {
+			if strings.EqualFold(account, ctx.Account) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Highest role any grant gives the sender in the channel the command came from.
+func user_role(ctx *CommandContext) Role {
+	role := RoleUser
+	for _, grant := range role_grants {
+		if grant.Role > role && grant.matches(ctx) {
+			role = grant.Role
+		}
+	}
+	hostmask := hostmask_of(ctx.Sender, ctx.Line.Ident, ctx.SenderHost)
+	if session := ctx.Zax.session(ctx.Sender, hostmask); session != nil && session.Role > role {
+		role = session.Role
+	}
+	log.Debugf("%s (%s, account %s) has role %s.", ctx.Sender, ctx.SenderHost, ctx.Account, role)
+	return role
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	irc "github.com/fluffle/goirc/client"
+	"strings"
+	"testing"
+)
+
+func TestCompileRole(t *testing.T) {
+	tests := []struct {
+		rc      RoleConfig
+		problem string
+	}{
+		{RoleConfig{Role: "admin", Hostmasks: []string{"*!*@staff.example.com"}}, ""},
+		{RoleConfig{Role: "Trusted", Accounts: []string{"alice"}, Channels: []string{"#chan", "net/#other"}}, ""},
+		{RoleConfig{Role: "owner", Hostmasks: []string{`/^bob!\w+@home$/`}}, ""},
+		{RoleConfig{Role: "god", Accounts: []string{"alice"}}, "unknown role 'god'"},
+		{RoleConfig{Role: "admin"}, "has no Hostmasks or Accounts"},
+		{RoleConfig{Role: "admin", Hostmasks: []string{"bob"}}, "'bob' is not a full nick!user@host mask"},
+		{RoleConfig{Role: "admin", Hostmasks: []string{"*@host"}}, "'*@host' is not a full nick!user@host mask"},
+		{RoleConfig{Role: "admin", Hostmasks: []string{"/bob(/"}}, "invalid mask '/bob(/'"},
+		{RoleConfig{Role: "admin", Accounts: []string{"alice"}, Channels: []string{"chan"}}, "'chan' is not a channel name"},
+		{RoleConfig{Role: "admin", Accounts: []string{"alice"}, Channels: []string{"net/"}}, "'net/' is not a channel name"},
+	}
+	for i, test := range tests {
+		grant, err := compile_role(test.rc)
+		switch {
+		case test.problem == "" && err != nil:
+			t.Errorf("role %d: unexpected error %s", i+1, err.Error())
+		case test.problem == "" && grant.Role.String() != strings.ToLower(test.rc.Role):
+			t.Errorf("role %d: got role %s, want %s", i+1, grant.Role, test.rc.Role)
+		case test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)):
+			t.Errorf("role %d: got %v, want an error about %s", i+1, err, test.problem)
+		}
+	}
+}
+
+func TestUserRole(t *testing.T) {
+	saved := role_grants
+	defer func() { role_grants = saved }()
+	cfg := test_config(nil, nil)
+	cfg.Admin = "host:^legacy\\.example\\.com$"
+	cfg.Roles = []RoleConfig{
+		{Role: "trusted", Hostmasks: []string{"*!*@*.example.org"}},
+		{Role: "admin", Hostmasks: []string{"*!carol@staff.example.org"}},
+		{Role: "owner", Accounts: []string{"Alice"}},
+		{Role: "admin", Accounts: []string{"dave"}, Channels: []string{"#ops", "net/#dev", "other/#test"}},
+	}
+	grants, err := compile_roles(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	role_grants = grants
+	zax, _ := test_network("net")
+	defer zax.queue.Stop()
+
+	tests := []struct {
+		name                       string
+		nick, ident, host, channel string
+		account                    string
+		want                       Role
+	}{
+		{"nobody", "eve", "eve", "evil.example.net", "#chan", "", RoleUser},
+		{"hostmask", "bob", "bob", "home.example.org", "#chan", "", RoleTrusted},
+		{"highest of two hostmasks", "carol", "carol", "staff.example.org", "#chan", "", RoleAdmin},
+		{"ident must match", "carol", "notcarol", "staff.example.org", "#chan", "", RoleTrusted},
+		{"account", "whoever", "x", "evil.example.net", "#chan", "alice", RoleOwner},
+		{"account beats hostmask", "carol", "carol", "staff.example.org", "#chan", "ALICE", RoleOwner},
+		{"no account, no grant", "alice", "alice", "evil.example.net", "#chan", "", RoleUser},
+		{"in a listed channel", "dave", "dave", "evil.example.net", "#OPS", "dave", RoleAdmin},
+		{"in another channel", "dave", "dave", "evil.example.net", "#chan", "dave", RoleUser},
+		{"in a channel listed with the network", "dave", "dave", "evil.example.net", "#dev", "dave", RoleAdmin},
+		{"channel of another network", "dave", "dave", "evil.example.net", "#test", "dave", RoleUser},
+		{"in a query", "dave", "dave", "evil.example.net", "", "dave", RoleUser},
+		{"legacy Admin", "anyone", "x", "legacy.example.com", "#chan", "", RoleAdmin},
+		{"legacy Admin anchored", "anyone", "x", "legacy.example.com.evil.net", "#chan", "", RoleUser},
+	}
+	for _, test := range tests {
+		ctx := &CommandContext{
+			Zax:        zax,
+			Line:       &irc.Line{Nick: test.nick, Ident: test.ident, Host: test.host},
+			Sender:     test.nick,
+			SenderHost: test.host,
+			Channel:    test.channel,
+			Account:    test.account,
+		}
+		if got := user_role(ctx); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	// The legacy rule can also match on the nick.
+	cfg = test_config(nil, nil)
+	cfg.Admin = "nick:^boss$"
+	if role_grants, err = compile_roles(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	for nick, want := range map[string]Role{"boss": RoleAdmin, "bossy": RoleUser} {
+		ctx := &CommandContext{Zax: zax, Line: &irc.Line{Nick: nick}, Sender: nick, SenderHost: "h", Channel: "#chan"}
+		if got := user_role(ctx); got != want {
+			t.Errorf("legacy nick rule, %s: got %s, want %s", nick, got, want)
+		}
+	}
+}
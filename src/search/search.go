@@ -0,0 +1,500 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"history"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// How results are sorted.
+type Order int
+
+const (
+	Recent    Order = iota // Newest first.
+	Relevance              // Best match first, newest first among equals.
+)
+
+type Result struct {
+	Record history.Record
+	Score  float64
+}
+
+type posting struct {
+	doc       int32
+	positions []int32 // Word positions in the message, for phrases.
+}
+
+type document struct {
+	record history.Record
+	length int // In words.
+}
+
+// Inverted index over messages, kept in memory. Messages are added as they're
+// logged and the whole thing can be rebuilt from the history store.
+// With a limit only the newest messages are kept, up to a quarter more
+// than the limit is allowed so old ones don't have to be dropped on every add.
+type Index struct {
+	lock     sync.RWMutex
+	limit    int
+	docs     []document // Oldest first, the position is the doc id.
+	postings map[string][]posting
+}
+
+// An index of at most limit messages, no limit if it's 0.
+func New(limit int) *Index {
+	return &Index{limit: limit, docs: []document{}, postings: make(map[string][]posting)}
+}
+
+// Lower case words, anything that isn't a letter or digit separates them.
+func Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (index *Index) add(record history.Record) {
+	id := int32(len(index.docs))
+	words := Words(record.Text)
+	index.docs = append(index.docs, document{record, len(words)})
+	for pos, word := range words {
+		list := index.postings[word]
+		if n := len(list); n > 0 && list[n-1].doc == id {
+			list[n-1].positions = append(list[n-1].positions, int32(pos))
+			continue
+		}
+		index.postings[word] = append(list, posting{id, []int32{int32(pos)}})
+	}
+}
+
+func (index *Index) Add(record history.Record) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	index.add(record)
+	if index.limit > 0 && len(index.docs) > index.limit+index.limit/4 {
+		fresh := New(index.limit)
+		for _, doc := range index.docs[len(index.docs)-index.limit:] {
+			fresh.add(doc.record)
+		}
+		index.docs, index.postings = fresh.docs, fresh.postings
+	}
+}
+
+// Replaces everything in the index with the newest limit of records, oldest first,
+// and keeps it to that size from now on.
+func (index *Index) Rebuild(records []history.Record, limit int) {
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	fresh := New(limit)
+	for _, record := range records {
+		fresh.add(record)
+	}
+	index.lock.Lock()
+	index.limit, index.docs, index.postings = limit, fresh.docs, fresh.postings
+	index.lock.Unlock()
+}
+
+func (index *Index) Len() int {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	return len(index.docs)
+}
+
+// Finds the messages matching query that also pass filter, at most limit of them
+// unless it's 0. Gives up with history.ErrDeadline once filter.Deadline has passed.
+func (index *Index) Search(query *Query, filter history.Filter, order Order, limit int) ([]Result, error) {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	docs := query.root.eval(index)
+	results := []Result{}
+	for i := len(docs) - 1; i >= 0; i-- {
+		if filter.Expired(len(docs) - 1 - i) {
+			return nil, history.ErrDeadline
+		}
+		doc := &index.docs[docs[i]]
+		if !filter.Matches(&doc.record) {
+			continue
+		}
+		result := Result{Record: doc.record}
+		if order == Relevance {
+			result.Score = index.score(query, docs[i])
+		} else if limit > 0 && len(results) == limit {
+			break
+		}
+		results = append(results, result)
+	}
+	if order == Relevance {
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].Score > results[j].Score
+		})
+	}
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// tf-idf over the words the query looks for, with long messages weighing less.
+func (index *Index) score(query *Query, id int32) float64 {
+	score := 0.0
+	for _, word := range query.words {
+		list := index.postings[word]
+		if p := find_posting(list, id); p != nil {
+			idf := math.Log(1 + float64(len(index.docs))/float64(len(list)))
+			score += float64(len(p.positions)) * idf
+		}
+	}
+	return score / math.Sqrt(float64(index.docs[id].length)+1)
+}
+
+func find_posting(list []posting, id int32) *posting {
+	i := sort.Search(len(list), func(i int) bool { return list[i].doc >= id })
+	if i < len(list) && list[i].doc == id {
+		return &list[i]
+	}
+	return nil
+}
+
+// Query syntax: words, "phrases", OR, AND (or nothing), NOT or -word, and parentheses.
+// NOT binds tightest, then AND, then OR.
+type Query struct {
+	root  node
+	words []string // Words the query looks for, for ranking.
+}
+
+type node interface {
+	eval(index *Index) []int32 // Sorted doc ids.
+	fts() (string, error)      // The same in FTS5 query syntax.
+}
+
+// FTS5 has no NOT on its own, only "a NOT b".
+var ErrOnlyNot = errors.New("-word and NOT need a word to search for next to them")
+
+// The query in FTS5 syntax, for a full text index in SQLite. Words are quoted,
+// so nothing in them is taken for syntax.
+func (query *Query) FTS() (string, error) {
+	return query.root.fts()
+}
+
+func (n term_node) fts() (string, error) {
+	return `"` + strings.Join(n.words, " ") + `"`, nil
+}
+
+func (n and_node) fts() (string, error) {
+	left, right, op := n.left, n.right, "AND"
+	if not, ok := left.(not_node); ok {
+		left, right = right, not
+	}
+	if not, ok := right.(not_node); ok {
+		right, op = not.operand, "NOT"
+	}
+	l, err := left.fts()
+	if err != nil {
+		return "", err
+	}
+	r, err := right.fts()
+	if err != nil {
+		return "", err
+	}
+	return "(" + l + " " + op + " " + r + ")", nil
+}
+
+func (n or_node) fts() (string, error) {
+	l, err := n.left.fts()
+	if err != nil {
+		return "", err
+	}
+	r, err := n.right.fts()
+	if err != nil {
+		return "", err
+	}
+	return "(" + l + " OR " + r + ")", nil
+}
+
+func (n not_node) fts() (string, error) {
+	return "", ErrOnlyNot
+}
+
+type term_node struct{ words []string } // One word, or a phrase.
+type and_node struct{ left, right node }
+type or_node struct{ left, right node }
+type not_node struct{ operand node }
+
+func (n term_node) eval(index *Index) []int32 {
+	docs := ids(index.postings[n.words[0]])
+	for _, word := range n.words[1:] {
+		docs = intersect(docs, ids(index.postings[word]))
+	}
+	if len(n.words) == 1 {
+		return docs
+	}
+	phrase := []int32{}
+	for _, id := range docs {
+		if index.has_phrase(id, n.words) {
+			phrase = append(phrase, id)
+		}
+	}
+	return phrase
+}
+
+func (index *Index) has_phrase(id int32, words []string) bool {
+	positions := make([][]int32, len(words))
+	for i, word := range words {
+		positions[i] = find_posting(index.postings[word], id).positions
+	}
+	for _, start := range positions[0] {
+		found := true
+		for i := 1; i < len(words) && found; i++ {
+			found = contains(positions[i], start+int32(i))
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (n and_node) eval(index *Index) []int32 {
+	// "a -b" is a AND NOT b, which doesn't need every document.
+	if not, ok := n.right.(not_node); ok {
+		return subtract(n.left.eval(index), not.operand.eval(index))
+	}
+	if not, ok := n.left.(not_node); ok {
+		return subtract(n.right.eval(index), not.operand.eval(index))
+	}
+	return intersect(n.left.eval(index), n.right.eval(index))
+}
+
+func (n or_node) eval(index *Index) []int32 {
+	return union(n.left.eval(index), n.right.eval(index))
+}
+
+func (n not_node) eval(index *Index) []int32 {
+	all := make([]int32, len(index.docs))
+	for i := range all {
+		all[i] = int32(i)
+	}
+	return subtract(all, n.operand.eval(index))
+}
+
+func ids(list []posting) []int32 {
+	docs := make([]int32, len(list))
+	for i, p := range list {
+		docs[i] = p.doc
+	}
+	return docs
+}
+
+func contains(sorted []int32, value int32) bool {
+	i := sort.Search(len(sorted), func(i int) bool { return sorted[i] >= value })
+	return i < len(sorted) && sorted[i] == value
+}
+
+func intersect(a, b []int32) []int32 {
+	result := []int32{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+func union(a, b []int32) []int32 {
+	result := []int32{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+func subtract(a, b []int32) []int32 {
+	result := []int32{}
+	for i, j := 0, 0; i < len(a); i++ {
+		for j < len(b) && b[j] < a[i] {
+			j++
+		}
+		if j == len(b) || b[j] != a[i] {
+			result = append(result, a[i])
+		}
+	}
+	return result
+}
+
+type token struct {
+	kind string // word, phrase, OR, AND, NOT, (, )
+	text string
+}
+
+func lex(query string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, token{string(r), ""})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, token{"NOT", ""})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("a phrase is missing its closing quote")
+			}
+			tokens = append(tokens, token{"phrase", string(runes[i+1 : end])})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()\"", runes[end]) {
+				end++
+			}
+			text := string(runes[i:end])
+			switch text {
+			case "OR", "AND", "NOT":
+				tokens = append(tokens, token{text, ""})
+			default:
+				tokens = append(tokens, token{"word", text})
+			}
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	words  []string
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return ""
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "OR" {
+		p.pos++
+		var right node
+		if right, err = p.and(); err == nil {
+			left = or_node{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	for err == nil {
+		switch p.peek() {
+		case "", "OR", ")":
+			return left, nil
+		case "AND":
+			p.pos++
+		}
+		var right node
+		if right, err = p.unary(); err == nil {
+			left = and_node{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) unary() (node, error) {
+	if p.peek() != "NOT" {
+		return p.primary()
+	}
+	p.pos++
+	// Words under a NOT aren't what we're looking for, keep them out of the ranking.
+	words := p.words
+	operand, err := p.unary()
+	p.words = words
+	if err != nil {
+		return nil, err
+	}
+	return not_node{operand}, nil
+}
+
+func (p *parser) primary() (node, error) {
+	if p.pos == len(p.tokens) {
+		return nil, errors.New("the search ends too early")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case "(":
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("a '(' is never closed")
+		}
+		p.pos++
+		return n, nil
+	case "word", "phrase":
+		words := Words(t.text)
+		if len(words) == 0 {
+			return nil, fmt.Errorf("nothing to search for in '%s'", t.text)
+		}
+		p.words = append(p.words, words...)
+		return term_node{words}, nil
+	case ")":
+		return nil, errors.New("a ')' has no matching '('")
+	}
+	return nil, fmt.Errorf("%s needs a word on both sides", t.kind)
+}
+
+func Parse(query string) (*Query, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("nothing to search for")
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("a ')' has no matching '('")
+	}
+	return &Query{root, p.words}, nil
+}
@@ -0,0 +1,162 @@
+package search
+
+import (
+	"history"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var test_messages = []string{
+	"the quick brown fox",
+	"a lazy dog sleeps",
+	"quick thinking saves the day",
+	"brown bread and a quick coffee",
+	"Die Füchse sind schnell",
+}
+
+func test_index(limit int) *Index {
+	index := New(limit)
+	for i, text := range test_messages {
+		index.Add(history.Record{Kind: history.KindMessage, Time: int64(i + 1), User: "u", Text: text})
+	}
+	return index
+}
+
+func found_texts(results []Result) string {
+	texts := []string{}
+	for _, result := range results {
+		texts = append(texts, result.Record.Text)
+	}
+	return strings.Join(texts, "|")
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"quick", "brown bread and a quick coffee|quick thinking saves the day|the quick brown fox"},
+		{"quick brown", "brown bread and a quick coffee|the quick brown fox"},
+		{`"quick brown"`, "the quick brown fox"},
+		{`"brown quick"`, ""},
+		{"fox OR dog", "a lazy dog sleeps|the quick brown fox"},
+		{"quick -brown", "quick thinking saves the day"},
+		{"quick NOT brown", "quick thinking saves the day"},
+		{"-quick", "Die Füchse sind schnell|a lazy dog sleeps"},
+		{"(fox OR bread) AND brown", "brown bread and a quick coffee|the quick brown fox"},
+		{"QUICK fox", "the quick brown fox"},
+		{"füchse", "Die Füchse sind schnell"},
+		{"cat", ""},
+	}
+	index := test_index(0)
+	for _, test := range tests {
+		query, err := Parse(test.query)
+		if err != nil {
+			t.Errorf("%s: %s", test.query, err.Error())
+			continue
+		}
+		results, err := index.Search(query, history.Filter{}, Recent, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := found_texts(results); got != test.want {
+			t.Errorf("%s: found %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	index := test_index(0)
+	query, _ := Parse("quick brown")
+	results, _ := index.Search(query, history.Filter{}, Relevance, 0)
+	if got := found_texts(results); got != "the quick brown fox|brown bread and a quick coffee" {
+		t.Errorf("by relevance: %q", got)
+	}
+	results, _ = index.Search(query, history.Filter{}, Recent, 1)
+	if got := found_texts(results); got != "brown bread and a quick coffee" {
+		t.Errorf("newest: %q", got)
+	}
+	results, _ = index.Search(query, history.Filter{Before: 4}, Recent, 0)
+	if got := found_texts(results); got != "the quick brown fox" {
+		t.Errorf("filtered: %q", got)
+	}
+	skip := history.Record{Kind: history.KindMessage, Time: 4, User: "u", Text: test_messages[3]}
+	results, _ = index.Search(query, history.Filter{Skip: &skip}, Recent, 0)
+	if got := found_texts(results); got != "the quick brown fox" {
+		t.Errorf("skipping the newest: %q", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, query := range []string{"", `"open`, "(a", "a)", "a OR", "AND a", "!!!", "-"} {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("%q parsed", query)
+		}
+	}
+}
+
+func TestFTS(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		err   error
+	}{
+		{"quick", `"quick"`, nil},
+		{"Quick brown", `("quick" AND "brown")`, nil},
+		{`"quick brown" fox`, `("quick brown" AND "fox")`, nil},
+		{"fox OR dog", `("fox" OR "dog")`, nil},
+		{"quick -brown", `("quick" NOT "brown")`, nil},
+		{"-brown quick", `("quick" NOT "brown")`, nil},
+		{"(a OR b) NOT c", `(("a" OR "b") NOT "c")`, nil},
+		{`don't "NEAR"`, `("don t" AND "near")`, nil},
+		{"-brown", "", ErrOnlyNot},
+		{"-a -b", "", ErrOnlyNot},
+		{"a OR -b", "", ErrOnlyNot},
+	}
+	for _, test := range tests {
+		query, err := Parse(test.query)
+		if err != nil {
+			t.Errorf("%s: %s", test.query, err.Error())
+			continue
+		}
+		got, err := query.FTS()
+		if got != test.want || err != test.err {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.query, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	index := test_index(2)
+	// Up to a quarter more is kept, then it's cut back to the limit.
+	if index.Len() != 2 {
+		t.Errorf("Len %d after adding %d with a limit of 2", index.Len(), len(test_messages))
+	}
+	query, _ := Parse("quick")
+	results, _ := index.Search(query, history.Filter{}, Recent, 0)
+	if got := found_texts(results); got != "brown bread and a quick coffee" {
+		t.Errorf("found %q, want only the newest", got)
+	}
+
+	records := []history.Record{}
+	for i := 0; i < 10; i++ {
+		records = append(records, history.Record{Kind: history.KindMessage, Time: int64(i), User: "u", Text: "word"})
+	}
+	index.Rebuild(records, 4)
+	query, _ = Parse("word")
+	results, _ = index.Search(query, history.Filter{}, Recent, 0)
+	times := []int64{}
+	for _, result := range results {
+		times = append(times, result.Record.Time)
+	}
+	if !reflect.DeepEqual(times, []int64{9, 8, 7, 6}) {
+		t.Errorf("kept %v after rebuilding with a limit of 4", times)
+	}
+	for i := 0; i < 5; i++ {
+		index.Add(history.Record{Kind: history.KindMessage, Time: int64(10 + i), User: "u", Text: "word"})
+		if n := index.Len(); n > 5 {
+			t.Fatalf("%d messages with a limit of 4", n)
+		}
+	}
+}